@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// typeALIAS is the private record type of ALIAS records, as used by
+// PowerDNS. They are never served or transferred as such, but flattened to
+// the A and AAAA records of their target.
+const typeALIAS uint16 = 65401
+
+// aliasQuery is an A or AAAA query at name answered by flattening the ALIAS
+// target.
+type aliasQuery struct {
+	name   string
+	target string
+	qtype  uint16
+}
+
+var aliasCache = struct {
+	sync.Mutex
+	entries map[dns.Question]aliasCacheEntry
+}{entries: map[dns.Question]aliasCacheEntry{}}
+
+type aliasCacheEntry struct {
+	rr     []dns.RR
+	expire time.Time
+}
+
+// flattenAlias returns the records of type qtype of the target of a, owned
+// by the name of a with a TTL of at most ttl. Targets in the zones of nsbox
+// are resolved in the view v following CNAMEs, others by the upstream
+// resolver. seen holds the names followed so far, see followCNAME. No zone
+// lock may be held by the caller.
+func flattenAlias(a aliasQuery, v *view, ttl uint32, seen map[string]bool) ([]dns.RR, error) {
+	chain, err := followCNAME(a.target, a.qtype, v, false, seen)
+	if err != nil {
+		return nil, err
+	}
+	rr := chain.answer
+	if chain.external != "" {
+		if rr, err = resolveUpstream(chain.external, a.qtype); err != nil {
+			return nil, err
+		}
+	}
+	result := []dns.RR{}
+	for _, _rr := range rr {
+		if _rr.Header().Rrtype != a.qtype {
+			continue
+		}
+		flat := dns.Copy(_rr)
+		flat.Header().Name = a.name
+		if flat.Header().Ttl > ttl {
+			flat.Header().Ttl = ttl
+		}
+		result = append(result, flat)
+	}
+	return result, nil
+}
+
+// resolveUpstream asks server.resolver for the records of type qtype of
+// name and caches them for their TTL.
+func resolveUpstream(name string, qtype uint16) ([]dns.RR, error) {
+	if config.Server.Resolver == nil {
+		return nil, fmt.Errorf("alias: no resolver for %s", name)
+	}
+	q := dns.Question{Name: strings.ToLower(name), Qtype: qtype, Qclass: dns.ClassINET}
+	aliasCache.Lock()
+	entry, ok := aliasCache.entries[q]
+	aliasCache.Unlock()
+	if ok && time.Now().Before(entry.expire) {
+		return entry.rr, nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(q.Name, qtype)
+	client := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+	r, _, err := client.Exchange(m, *config.Server.Resolver)
+	if err == nil && r.Truncated {
+		client.Net = "tcp"
+		r, _, err = client.Exchange(m, *config.Server.Resolver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("alias: %s for %s", dns.RcodeToString[r.Rcode], name)
+	}
+	// negative answers are kept for a minute.
+	ttl := uint32(60)
+	rr := []dns.RR{}
+	for _, _rr := range r.Answer {
+		if _rr.Header().Rrtype != qtype {
+			continue
+		}
+		if len(rr) == 0 || _rr.Header().Ttl < ttl {
+			ttl = _rr.Header().Ttl
+		}
+		rr = append(rr, _rr)
+	}
+	aliasCache.Lock()
+	aliasCache.entries[q] = aliasCacheEntry{rr: rr, expire: time.Now().Add(time.Duration(ttl) * time.Second)}
+	aliasCache.Unlock()
+	return rr, nil
+}
+
+// getAlias returns the ALIAS target of fqdn.
+func (zm *zoneManager) getAlias(fqdn string) (string, bool) {
+	prefix, err := zm.getPrefixByOrigin(fqdn)
+	if err != nil {
+		return "", false
+	}
+	if wildcard, ok := zm.getWildcard(prefix); ok {
+		prefix = wildcard
+	}
+	for _, record := range zm.Tree.Records[prefix] {
+		if record.DNSType == typeALIAS {
+			return record.ALIAS, true
+		}
+	}
+	return "", false
+}
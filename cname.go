@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain is the number of names followed in a CNAME chain, beyond
+// which the chain is answered as far as it was followed.
+const maxCNAMEChain = 16
+
+// cnameQuery is a query at name answered by the CNAME chain from target.
+type cnameQuery struct {
+	name   string
+	target string
+	qtype  uint16
+}
+
+// cnameChain is the rest of the answer to a cnameQuery.
+type cnameChain struct {
+	answer []dns.RR
+	ns     []dns.RR
+	rcode  int
+	// external is the target the chain ends at when it is outside of the
+	// zones, which is left to the resolver of the client.
+	external string
+}
+
+// followCNAME follows the CNAME chain from target through the zones of nsbox
+// in the view v, up to the records of type qtype at its end. The records are
+// signed by their zones when dnssec is set. seen holds the names of the
+// chain so far, which stops loops. No zone lock may be held by the caller.
+func followCNAME(target string, qtype uint16, v *view, dnssec bool, seen map[string]bool) (*cnameChain, error) {
+	chain := &cnameChain{rcode: dns.RcodeSuccess}
+	for {
+		name := strings.ToLower(target)
+		if seen[name] || len(seen) >= maxCNAMEChain {
+			return chain, nil
+		}
+		seen[name] = true
+		zm, ok := authoritative.zone(target, v)
+		if !ok {
+			chain.external = target
+			return chain, nil
+		}
+		zm.mu.RLock()
+		next, alias := zm.chainStep(chain, target, qtype, dnssec)
+		zm.mu.RUnlock()
+		if alias != nil {
+			rr, err := flattenAlias(*alias, v, zm.ZoneConfig.TTL, seen)
+			if err != nil {
+				return nil, err
+			}
+			zm.mu.RLock()
+			if len(rr) == 0 {
+				zm.chainDenial(chain, target, false, dnssec)
+			} else {
+				zm.chainAnswer(chain, target, rr, dnssec)
+			}
+			zm.mu.RUnlock()
+			return chain, nil
+		}
+		if next == "" {
+			return chain, nil
+		}
+		target = next
+	}
+}
+
+// chainStep adds the records at target to chain, and returns the next target
+// of the chain, or the ALIAS to be flattened for it.
+func (zm *zoneManager) chainStep(chain *cnameChain, target string, qtype uint16, dnssec bool) (string, *aliasQuery) {
+	prefix, err := zm.getPrefixByOrigin(target)
+	if err != nil {
+		return "", nil
+	}
+	if _, ok := zm.getDelegation(prefix); ok {
+		// the child zone is left to the resolver as well.
+		return "", nil
+	}
+	if cnames, _ := zm.resolve(target, []uint16{dns.TypeCNAME}, false); len(cnames) != 0 {
+		zm.chainAnswer(chain, target, cnames[:1], dnssec)
+		return cnames[0].(*dns.CNAME).Target, nil
+	}
+	results, exists := zm.lookup(target, qtype)
+	if len(results) == 0 && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+		if aliasTarget, ok := zm.getAlias(target); ok {
+			return "", &aliasQuery{name: target, target: aliasTarget, qtype: qtype}
+		}
+	}
+	if len(results) == 0 {
+		zm.chainDenial(chain, target, !exists, dnssec)
+		return "", nil
+	}
+	zm.chainAnswer(chain, target, results, dnssec)
+	return "", nil
+}
+
+// chainAnswer adds rr at target to the answer of chain, signed along with
+// the proof of wildcard expansion when the zone is signed.
+func (zm *zoneManager) chainAnswer(chain *cnameChain, target string, rr []dns.RR, dnssec bool) {
+	if dnssec && zm.Signer != nil {
+		if _, ok := zm.getWildcardName(target); ok {
+			chain.ns = append(chain.ns, zm.signRRs([]dns.RR{zm.covering(target)})...)
+		}
+		rr = zm.signRRs(rr)
+	}
+	chain.answer = append(chain.answer, rr...)
+}
+
+// chainDenial ends chain with the SOA of the zone, as target does not exist
+// or has no records of the type.
+func (zm *zoneManager) chainDenial(chain *cnameChain, target string, nxdomain bool, dnssec bool) {
+	if nxdomain {
+		chain.rcode = dns.RcodeNameError
+	}
+	ns := []dns.RR{zm.getSOAonError()}
+	if dnssec && zm.Signer != nil {
+		ns = zm.signRRs(append(ns, zm.denial(target, nxdomain)...))
+	}
+	chain.ns = append(chain.ns, ns...)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFollowCNAME(t *testing.T) {
+	records := map[string][]dnsRecord{
+		"a":   {{DNSType: dns.TypeA, A: net.ParseIP("192.0.2.1")}},
+		"c":   {{DNSType: dns.TypeCNAME, CNAME: "a.example.com."}},
+		"l1":  {{DNSType: dns.TypeCNAME, CNAME: "l2.example.com."}},
+		"l2":  {{DNSType: dns.TypeCNAME, CNAME: "l1.example.com."}},
+		"ext": {{DNSType: dns.TypeCNAME, CNAME: "www.example.org."}},
+		"nx":  {{DNSType: dns.TypeCNAME, CNAME: "none.example.com."}},
+	}
+	for i := 0; i < 2*maxCNAMEChain; i++ {
+		records[fmt.Sprintf("d%d", i)] = []dnsRecord{{DNSType: dns.TypeCNAME, CNAME: fmt.Sprintf("d%d.example.com.", i+1)}}
+	}
+	zm := newTestZone("example.com.", records)
+	defer func(mux zoneMux) { authoritative = mux }(authoritative)
+	authoritative = zoneMux{"example.com.": viewSelector{nil: zm}}
+
+	tests := []struct {
+		name string
+		// query is the name whose CNAME points to target.
+		query    string
+		target   string
+		answer   int
+		rcode    int
+		external string
+	}{
+		{"chain", "q.example.com.", "c.example.com.", 2, dns.RcodeSuccess, ""},
+		{"answer", "q.example.com.", "a.example.com.", 1, dns.RcodeSuccess, ""},
+		// l2 points back to l1, which is the query.
+		{"loop", "l1.example.com.", "l2.example.com.", 1, dns.RcodeSuccess, ""},
+		{"depth", "d0.example.com.", "d1.example.com.", maxCNAMEChain - 1, dns.RcodeSuccess, ""},
+		{"external", "q.example.com.", "ext.example.com.", 1, dns.RcodeSuccess, "www.example.org."},
+		{"outside", "q.example.com.", "www.example.net.", 0, dns.RcodeSuccess, "www.example.net."},
+		{"nxdomain", "q.example.com.", "nx.example.com.", 1, dns.RcodeNameError, ""},
+	}
+	for _, tt := range tests {
+		seen := map[string]bool{tt.query: true}
+		chain, err := followCNAME(tt.target, dns.TypeA, nil, false, seen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chain.answer) != tt.answer || chain.rcode != tt.rcode || chain.external != tt.external {
+			t.Errorf("%s: answer %d rcode %s external %q, want %d %s %q", tt.name,
+				len(chain.answer), dns.RcodeToString[chain.rcode], chain.external,
+				tt.answer, dns.RcodeToString[tt.rcode], tt.external)
+		}
+	}
+}
@@ -9,12 +9,42 @@ type Config struct {
 	Zones       []zoneConfig       `yaml:"zones"`
 	TsigSecrets []tsigSecretConfig `yaml:"tsigSecrets"`
 	Netbox      netboxConfig       `yaml:"netbox"`
+	Views       []viewConfig       `yaml:"views"`
+	QueryLog    *queryLogConfig    `yaml:"queryLog"`
+	Metrics     *metricsConfig     `yaml:"metrics"`
 	Slack       slackConfig        `yaml:"slack"`
 }
 
+type queryLogConfig struct {
+	// Format is text or json, logged to File or the standard log. Empty
+	// disables it, e.g. when only dnstap is used.
+	Format string        `yaml:"format"`
+	File   string        `yaml:"file"`
+	Dnstap *dnstapConfig `yaml:"dnstap"`
+}
+
+// metricsConfig serves the Prometheus metrics.
+type metricsConfig struct {
+	// Path of the endpoint, /metrics by default.
+	Path   string `yaml:"path"`
+	Listen string `yaml:"listen"`
+	// Webhook mounts the endpoint on the webhook listener.
+	Webhook bool `yaml:"webhook"`
+}
+
+type dnstapConfig struct {
+	// File or Socket, the unix socket of a collector.
+	File   string `yaml:"file"`
+	Socket string `yaml:"socket"`
+	// Identity is the hostname by default.
+	Identity string `yaml:"identity"`
+}
+
 type dataStoreConfig struct {
 	Mode string `yaml:"mode"`
 	Path string `yaml:"path"`
+	// JournalSize is the number of zone changes kept for IXFR.
+	JournalSize int `yaml:"journalSize"`
 }
 
 type webhookConfig struct {
@@ -28,6 +58,51 @@ type serverConfig struct {
 	CPU         *int     `yaml:"cpu"`
 	SoReuseport *uint32  `yaml:"soReuseport"`
 	Listen      []string `yaml:"listen"`
+	// TrustedResolvers are the networks of the resolvers whose EDNS Client
+	// Subnet option selects the view and orders the addresses.
+	TrustedResolvers []string `yaml:"trustedResolvers"`
+	// TLS starts DNS over TLS (RFC 7858) listeners.
+	TLS *tlsConfig `yaml:"tls"`
+	// DoH serves DNS over HTTPS (RFC 8484).
+	DoH *dohConfig `yaml:"doh"`
+	// RateLimit limits the UDP responses per client network.
+	RateLimit *rateLimitConfig `yaml:"rateLimit"`
+	// Resolver (host:port) resolves ALIAS targets outside of the zones.
+	Resolver *string `yaml:"resolver"`
+	// MinimalResponses leaves out the addresses of NS, MX and SRV targets
+	// in the additional section. Glue of referrals is always added.
+	MinimalResponses bool `yaml:"minimalResponses"`
+}
+
+type rateLimitConfig struct {
+	ResponsesPerSecond uint32 `yaml:"responsesPerSecond"`
+	// Window in seconds, 15 by default.
+	Window *uint32 `yaml:"window"`
+	// Slip sends every n-th limited response truncated, 2 by default. 0
+	// drops every limited response.
+	Slip             *int     `yaml:"slip"`
+	IPv4PrefixLength *int     `yaml:"ipv4PrefixLength"`
+	IPv6PrefixLength *int     `yaml:"ipv6PrefixLength"`
+	Exempt           []string `yaml:"exempt"`
+}
+
+type dohConfig struct {
+	// Path of the endpoint, /dns-query by default.
+	Path string `yaml:"path"`
+	// Listen starts an own listener, which serves https when Cert and Key
+	// are given.
+	Listen string `yaml:"listen"`
+	Cert   string `yaml:"cert"`
+	Key    string `yaml:"key"`
+	// Webhook mounts the endpoint on the webhook listener.
+	Webhook bool `yaml:"webhook"`
+}
+
+type tlsConfig struct {
+	// Cert and Key are PEM files, which are reloaded when modified.
+	Cert   string   `yaml:"cert"`
+	Key    string   `yaml:"key"`
+	Listen []string `yaml:"listen"`
 }
 
 type zoneConfig struct {
@@ -38,24 +113,88 @@ type zoneConfig struct {
 	NS            *[]string                `yaml:"ns"`
 	Records       *[]addtionalRecordConfig `yaml:"records"`
 	AllowTransfer *[]string                `yaml:"allowTransfer"`
+	// TransferKeys are the tsig keys allowed to transfer the zone. Along
+	// with AllowTransfer, both have to match.
+	TransferKeys *[]string          `yaml:"transferKeys"`
+	DNSSEC       *dnssecConfig      `yaml:"dnssec"`
+	Notify       *notifyConfig      `yaml:"notify"`
+	TransferTLS  *transferTLSConfig `yaml:"transferTLS"`
+	// DynamicUpdate accepts RFC 2136 updates signed with a tsig key, which
+	// are limited to UpdateKeys and the networks of AllowUpdate when given.
+	DynamicUpdate *bool     `yaml:"dynamicUpdate"`
+	UpdateKeys    *[]string `yaml:"updateKeys"`
+	AllowUpdate   *[]string `yaml:"allowUpdate"`
+}
+
+type notifyConfig struct {
+	// Targets are addresses (host or host:port) of the secondaries.
+	Targets *[]string `yaml:"targets"`
+	// AllowTransfer also notifies every host address in allowTransfer.
+	AllowTransfer *bool   `yaml:"allowTransfer"`
+	TsigKey       *string `yaml:"tsigKey"`
+}
+
+// transferTLSConfig protects zone transfers with TLS (XoT, RFC 9103).
+type transferTLSConfig struct {
+	// Require only allows transfers over the DNS over TLS listener.
+	Require *bool `yaml:"require"`
+	// ClientCertificates are SHA-256 fingerprints of the client
+	// certificates allowed to transfer over TLS. Along with TsigKey, either
+	// one has to match when any of them is given.
+	ClientCertificates *[]string `yaml:"clientCertificates"`
+	TsigKey            *string   `yaml:"tsigKey"`
+}
+
+type dnssecConfig struct {
+	// KSK and ZSK are paths of BIND style key files without the .key and
+	// .private extension. Missing files are generated. KSK is required, it
+	// signs the whole zone when ZSK is not given.
+	KSK       *string `yaml:"ksk"`
+	ZSK       *string `yaml:"zsk"`
+	Algorithm *string `yaml:"algorithm"`
 }
 
 type addtionalRecordConfig struct {
-	Name  string  `yaml:"name"`
-	CNAME *string `yaml:"cname"`
-	TXT   *string `yaml:"txt"`
+	// Name is relative to the suffix, "" or "@" for the apex.
+	Name  string           `yaml:"name"`
+	A     *string          `yaml:"a"`
+	AAAA  *string          `yaml:"aaaa"`
+	ALIAS *string          `yaml:"alias"`
+	CNAME *string          `yaml:"cname"`
+	TXT   *string          `yaml:"txt"`
+	NS    *string          `yaml:"ns"`
+	MX    *mxRecordConfig  `yaml:"mx"`
+	SRV   *srvRecordConfig `yaml:"srv"`
+}
+
+type srvRecordConfig struct {
+	Priority uint16 `yaml:"priority"`
+	Weight   uint16 `yaml:"weight"`
+	Port     uint16 `yaml:"port"`
+	Target   string `yaml:"target"`
+}
+
+type mxRecordConfig struct {
+	Preference uint16 `yaml:"preference"`
+	Exchange   string `yaml:"exchange"`
 }
 
 type tsigSecretConfig struct {
 	Name   string `yaml:"name"`
 	Secret string `yaml:"secret"`
+	// Algorithm is hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384 or
+	// hmac-sha512, hmac-md5 by default.
+	Algorithm *string `yaml:"algorithm"`
 }
 
 type zoneDefaultConfig struct {
-	SOA           soaConfig `yaml:"soa"`
-	TTL           *uint32   `yaml:"ttl"`
-	NS            *[]string `yaml:"ns"`
-	AllowTransfer *[]string `yaml:"allowTransfer"`
+	SOA           soaConfig          `yaml:"soa"`
+	TTL           *uint32            `yaml:"ttl"`
+	NS            *[]string          `yaml:"ns"`
+	AllowTransfer *[]string          `yaml:"allowTransfer"`
+	TransferKeys  *[]string          `yaml:"transferKeys"`
+	Notify        *notifyConfig      `yaml:"notify"`
+	TransferTLS   *transferTLSConfig `yaml:"transferTLS"`
 }
 
 type soaConfig struct {
@@ -75,6 +214,32 @@ type netboxConfig struct {
 	Token      string  `yaml:"token"`
 	Mode       string  `yaml:"mode"`
 	Interval   string  `yaml:"interval"`
+	// WriteBack writes A and AAAA records of dynamic updates to the ip
+	// addresses of netbox instead of the dynamic layer.
+	WriteBack bool `yaml:"writeBack"`
+	// Services enables SRV records generated from netbox services.
+	Services *netboxServicesConfig `yaml:"services"`
+}
+
+type netboxServicesConfig struct {
+	Priority uint16 `yaml:"priority"`
+	Weight   uint16 `yaml:"weight"`
+}
+
+type viewConfig struct {
+	Name string `yaml:"name"`
+	// Match are the client networks of the view.
+	Match  []string         `yaml:"match"`
+	Netbox viewNetboxConfig `yaml:"netbox"`
+}
+
+// viewNetboxConfig selects the netbox ip addresses of a view. Every given
+// filter has to match.
+type viewNetboxConfig struct {
+	// VRF is the name or route distinguisher of the vrf.
+	VRF    *string `yaml:"vrf"`
+	Tag    *string `yaml:"tag"`
+	Prefix *string `yaml:"prefix"`
 }
 
 type soa struct {
@@ -86,6 +251,18 @@ type soa struct {
 	MinTTL  uint32 `yaml:"minTTL"`
 }
 
+type transferTLS struct {
+	Require            bool     `yaml:"require"`
+	ClientCertificates []string `yaml:"clientCertificates"`
+	TsigKey            string   `yaml:"tsigKey"`
+}
+
+type notify struct {
+	Targets       []string `yaml:"targets"`
+	AllowTransfer bool     `yaml:"allowTransfer"`
+	TsigKey       string   `yaml:"tsigKey"`
+}
+
 type slackConfig struct {
 	WebhookURL string `yaml:"webhookURL"`
 	Channel    string `yaml:"channel"`
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"sync"
 
 	"gopkg.in/yaml.v2"
 )
@@ -27,9 +28,12 @@ type storeData struct {
 }
 
 type zoneStoreData struct {
-	Serial uint32   `yaml:"serial"`
-	Origin string   `yaml:"origin"`
-	Tree   *dnsTree `yaml:"tree"`
+	Serial  uint32         `yaml:"serial"`
+	Origin  string         `yaml:"origin"`
+	Tree    *dnsTree       `yaml:"tree"`
+	Base    *dnsTree       `yaml:"base,omitempty"`
+	Dynamic *dnsTree       `yaml:"dynamic,omitempty"`
+	Journal []journalEntry `yaml:"journal,omitempty"`
 }
 
 func newYamlDataStore(path string, zms *map[string]*zoneManager) dataStore {
@@ -37,13 +41,15 @@ func newYamlDataStore(path string, zms *map[string]*zoneManager) dataStore {
 		path: path,
 	}
 	err := yd.load()
-	if err != nil {
-		zoneData := map[string]zoneStoreData{}
-		for _, zm := range *zms {
-			zoneData[zm.ZoneConfig.Suffix] = zoneStoreData{}
-		}
+	if err != nil || yd.data.Zones == nil {
 		yd.data = &storeData{
-			Zones: zoneData,
+			Zones: map[string]zoneStoreData{},
+		}
+	}
+	// including zones and views added since the store was written.
+	for _, zm := range *zms {
+		if _, ok := yd.data.Zones[zm.name()]; !ok {
+			yd.data.Zones[zm.name()] = zoneStoreData{}
 		}
 	}
 	return yd
@@ -52,9 +58,12 @@ func newYamlDataStore(path string, zms *map[string]*zoneManager) dataStore {
 type yamlDataStore struct {
 	path string
 	data *storeData
+	mu   sync.Mutex
 }
 
 func (yd *yamlDataStore) setZone(zoneName string, data *zoneStoreData) error {
+	yd.mu.Lock()
+	defer yd.mu.Unlock()
 	_, ok := yd.data.Zones[zoneName]
 	if ok {
 		yd.data.Zones[zoneName] = *data
@@ -63,6 +72,8 @@ func (yd *yamlDataStore) setZone(zoneName string, data *zoneStoreData) error {
 	return fmt.Errorf("not found")
 }
 func (yd *yamlDataStore) getZone(zoneName string) (*zoneStoreData, error) {
+	yd.mu.Lock()
+	defer yd.mu.Unlock()
 	zoneData, ok := yd.data.Zones[zoneName]
 	if ok {
 		return &zoneData, nil
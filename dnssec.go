@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	signatureInception  = time.Hour
+	signatureValidity   = 7 * 24 * time.Hour
+	signatureRefreshing = 24 * time.Hour
+)
+
+type dnssecKey struct {
+	DNSKEY *dns.DNSKEY
+	Signer crypto.Signer
+}
+
+type zoneSigner struct {
+	KSK *dnssecKey
+	ZSK *dnssecKey
+
+	mu     sync.Mutex
+	serial uint32
+	sigs   map[string]signature
+	chain  []*dns.NSEC
+}
+
+// signature is a cached RRSIG along with the content of the RRset it
+// covers, which may change without a new serial, e.g. flattened ALIAS
+// records.
+type signature struct {
+	content string
+	sig     *dns.RRSIG
+}
+
+func newZoneSigner(zone *zone) (*zoneSigner, error) {
+	algorithm := dns.ECDSAP256SHA256
+	if zone.DNSSEC.Algorithm != nil {
+		alg, ok := dns.StringToAlgorithm[strings.ToUpper(*zone.DNSSEC.Algorithm)]
+		if !ok {
+			return nil, fmt.Errorf("unknown dnssec algorithm: %s", *zone.DNSSEC.Algorithm)
+		}
+		algorithm = alg
+	}
+	if zone.DNSSEC.KSK == nil {
+		// a key generated at every start would not match the published DS.
+		return nil, fmt.Errorf("dnssec.ksk not found for %s", zone.Origin)
+	}
+	ksk, err := loadOrGenerateKey(*zone.DNSSEC.KSK, zone.Origin, 257, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	var zsk *dnssecKey
+	if zone.DNSSEC.ZSK != nil {
+		zsk, err = loadOrGenerateKey(*zone.DNSSEC.ZSK, zone.Origin, 256, algorithm)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		zsk = ksk
+	}
+	log.Printf("dnssec: %s\n", ksk.DNSKEY.ToDS(dns.SHA256))
+	return &zoneSigner{
+		KSK:  ksk,
+		ZSK:  zsk,
+		sigs: map[string]signature{},
+	}, nil
+}
+
+func loadOrGenerateKey(path string, origin string, flags uint16, algorithm uint8) (*dnssecKey, error) {
+	pub, err := os.Open(path + ".key")
+	if os.IsNotExist(err) {
+		key, err := generateKey(origin, flags, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path+".key", []byte(key.DNSKEY.String()+"\n"), 0644); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path+".private", []byte(key.DNSKEY.PrivateKeyString(key.Signer)), 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("dnssec: generated %s\n", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer pub.Close()
+	rr, err := dns.ReadRR(pub, path+".key")
+	if err != nil {
+		return nil, err
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s.key: not a DNSKEY record", path)
+	}
+	if !strings.EqualFold(dnskey.Hdr.Name, origin) {
+		return nil, fmt.Errorf("%s.key: key is for %s", path, dnskey.Hdr.Name)
+	}
+	priv, err := os.Open(path + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer priv.Close()
+	privateKey, err := dnskey.ReadPrivateKey(priv, path+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s.private: unsupported private key", path)
+	}
+	return &dnssecKey{DNSKEY: dnskey, Signer: signer}, nil
+}
+
+func generateKey(origin string, flags uint16, algorithm uint8) (*dnssecKey, error) {
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}
+	bits := 256
+	switch algorithm {
+	case dns.RSASHA1, dns.RSASHA256, dns.RSASHA512, dns.RSASHA1NSEC3SHA1:
+		bits = 2048
+	case dns.ECDSAP384SHA384:
+		bits = 384
+	}
+	privateKey, err := dnskey.Generate(bits)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported dnssec algorithm: %d", algorithm)
+	}
+	return &dnssecKey{DNSKEY: dnskey, Signer: signer}, nil
+}
+
+func (zm *zoneManager) getDNSKEY() []dns.RR {
+	result := []dns.RR{}
+	for _, key := range []*dnssecKey{zm.Signer.KSK, zm.Signer.ZSK} {
+		if len(result) != 0 && key == zm.Signer.KSK {
+			continue
+		}
+		dnskey := *key.DNSKEY
+		dnskey.Hdr = dns.RR_Header{Name: zm.ZoneConfig.Origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL}
+		result = append(result, &dnskey)
+	}
+	return result
+}
+
+// signMsg adds the NSEC records proving a negative answer and signs every
+// RRset of the message that belongs to the zone.
+func (zm *zoneManager) signMsg(m *dns.Msg) {
+	if len(m.Question) != 0 && len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				m.Ns = append(m.Ns, zm.denial(m.Question[0].Name, m.Rcode == dns.RcodeNameError)...)
+				break
+			}
+		}
+	}
+	for _, rr := range m.Answer {
+		if len(m.Question) == 0 || !strings.EqualFold(rr.Header().Name, m.Question[0].Name) {
+			// the rest of a CNAME chain is proven by followCNAME.
+			continue
+		}
+		if _, ok := zm.getWildcardName(rr.Header().Name); ok {
+			// prove that there is no closer match than the wildcard.
+			m.Ns = append(m.Ns, zm.covering(rr.Header().Name))
+			break
+		}
+	}
+	if !m.Authoritative && len(m.Ns) != 0 && m.Ns[0].Header().Rrtype == dns.TypeNS {
+		// a referral proves that the child zone has no DS records.
+		m.Ns = append(m.Ns, zm.covering(m.Ns[0].Header().Name))
+	}
+	m.Answer = zm.signRRs(m.Answer)
+	m.Ns = zm.signRRs(m.Ns)
+	i := len(m.Extra)
+	for i > 0 {
+		t := m.Extra[i-1].Header().Rrtype
+		if t != dns.TypeOPT && t != dns.TypeTSIG {
+			break
+		}
+		i--
+	}
+	extra := zm.signRRs(m.Extra[:i])
+	m.Extra = append(extra, m.Extra[i:]...)
+}
+
+// isAuthoritative reports whether the RRset name/t is authoritative data of
+// the zone, which excludes everything below a zone cut and the cut itself
+// except for its DS and NSEC records.
+func (zm *zoneManager) isAuthoritative(name string, t uint16) bool {
+	prefix, err := zm.getPrefixByOrigin(name)
+	if err != nil {
+		return false
+	}
+	cut, ok := zm.getDelegation(prefix)
+	if !ok {
+		return true
+	}
+	return cut == prefix && (t == dns.TypeDS || t == dns.TypeNSEC)
+}
+
+// signRRs appends an RRSIG after each RRset of rrs which is authoritative data of the
+// zone and not signed yet.
+func (zm *zoneManager) signRRs(rrs []dns.RR) []dns.RR {
+	result := []dns.RR{}
+	for i := 0; i < len(rrs); {
+		hdr := rrs[i].Header()
+		j := i + 1
+		for j < len(rrs) && strings.EqualFold(rrs[j].Header().Name, hdr.Name) && rrs[j].Header().Rrtype == hdr.Rrtype {
+			j++
+		}
+		rrset := rrs[i:j]
+		result = append(result, rrset...)
+		i = j
+		if hdr.Rrtype == dns.TypeRRSIG || !zm.isAuthoritative(hdr.Name, hdr.Rrtype) {
+			continue
+		}
+		if j < len(rrs) {
+			// signed already, by the zone of a CNAME target.
+			if sig, ok := rrs[j].(*dns.RRSIG); ok && sig.TypeCovered == hdr.Rrtype {
+				continue
+			}
+		}
+		sig, err := zm.sign(rrset)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		result = append(result, sig)
+	}
+	return result
+}
+
+func (zm *zoneManager) sign(rrset []dns.RR) (*dns.RRSIG, error) {
+	if wildcard, ok := zm.getWildcardName(rrset[0].Header().Name); ok {
+		// records synthesized from a wildcard carry the signature of the
+		// wildcard records.
+		owner := rrset[0].Header().Name
+		wildcardRRset := []dns.RR{}
+		for _, rr := range rrset {
+			rr = dns.Copy(rr)
+			rr.Header().Name = wildcard
+			wildcardRRset = append(wildcardRRset, rr)
+		}
+		sig, err := zm.sign(wildcardRRset)
+		if err != nil {
+			return nil, err
+		}
+		synthesized := *sig
+		synthesized.Hdr.Name = owner
+		return &synthesized, nil
+	}
+	hdr := rrset[0].Header()
+	key := zm.Signer.ZSK
+	if hdr.Rrtype == dns.TypeDNSKEY {
+		key = zm.Signer.KSK
+	}
+	zm.Signer.mu.Lock()
+	defer zm.Signer.mu.Unlock()
+	zm.resetSignerCache()
+	cacheKey := fmt.Sprintf("%s/%d", strings.ToLower(hdr.Name), hdr.Rrtype)
+	content := rrsetContent(rrset)
+	if cached, ok := zm.Signer.sigs[cacheKey]; ok && cached.content == content &&
+		cached.sig.ValidityPeriod(time.Now().Add(signatureRefreshing)) {
+		return cached.sig, nil
+	}
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: hdr.Ttl},
+		Algorithm:  key.DNSKEY.Algorithm,
+		Inception:  uint32(now.Add(-signatureInception).Unix()),
+		Expiration: uint32(now.Add(signatureValidity).Unix()),
+		KeyTag:     key.DNSKEY.KeyTag(),
+		SignerName: zm.ZoneConfig.Origin,
+	}
+	if err := sig.Sign(key.Signer, rrset); err != nil {
+		return nil, err
+	}
+	zm.Signer.sigs[cacheKey] = signature{content: content, sig: sig}
+	return sig, nil
+}
+
+// rrsetContent returns the TTL and the data of the records of rrset in a
+// stable order.
+func rrsetContent(rrset []dns.RR) string {
+	rdata := []string{}
+	for _, rr := range rrset {
+		rdata = append(rdata, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	sort.Strings(rdata)
+	return fmt.Sprintf("%d %s", rrset[0].Header().Ttl, strings.Join(rdata, "\n"))
+}
+
+// resetSignerCache drops cached signatures and the NSEC chain when the zone
+// has been updated. The caller must hold zm.Signer.mu.
+func (zm *zoneManager) resetSignerCache() {
+	serial := zm.getSerial()
+	if zm.Signer.serial == serial {
+		return
+	}
+	zm.Signer.serial = serial
+	zm.Signer.sigs = map[string]signature{}
+	zm.Signer.chain = nil
+}
+
+// getNSECChain returns the NSEC records of the zone in canonical order.
+func (zm *zoneManager) getNSECChain() []*dns.NSEC {
+	zm.Signer.mu.Lock()
+	defer zm.Signer.mu.Unlock()
+	zm.resetSignerCache()
+	if zm.Signer.chain != nil {
+		return zm.Signer.chain
+	}
+	origin := zm.ZoneConfig.Origin
+	types := map[string]map[uint16]bool{
+		origin: {dns.TypeSOA: true, dns.TypeNS: true, dns.TypeDNSKEY: true},
+	}
+	for prefix, records := range zm.Tree.Records {
+		name := origin
+		if prefix != "" {
+			name = fmt.Sprintf("%s.%s", prefix, origin)
+		}
+		if cut, ok := zm.getDelegation(prefix); ok {
+			// only the delegation itself is part of the chain, glue and
+			// other records below the cut are not authoritative.
+			if cut == prefix {
+				types[name] = map[uint16]bool{dns.TypeNS: true}
+			}
+			continue
+		}
+		if _, ok := types[name]; !ok {
+			types[name] = map[uint16]bool{}
+		}
+		for _, record := range records {
+			if record.DNSType == typeALIAS {
+				types[name][dns.TypeA] = true
+				types[name][dns.TypeAAAA] = true
+				continue
+			}
+			types[name][record.DNSType] = true
+		}
+	}
+	names := []string{}
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return canonicalLess(names[i], names[j])
+	})
+	chain := []*dns.NSEC{}
+	for i, name := range names {
+		bitmap := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+		for t := range types[name] {
+			bitmap = append(bitmap, t)
+		}
+		sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+		chain = append(chain, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: zm.getNegativeTTL()},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: bitmap,
+		})
+	}
+	zm.Signer.chain = chain
+	return chain
+}
+
+// denial returns the NSEC records proving that qName (nxdomain) or the
+// queried type at qName does not exist.
+func (zm *zoneManager) denial(qName string, nxdomain bool) []dns.RR {
+	covering := zm.covering
+	nsec := covering(qName)
+	result := []dns.RR{nsec}
+	if !nxdomain {
+		if wildcard, ok := zm.getWildcardName(qName); ok {
+			// the type does not exist at the matching wildcard.
+			if w := covering(wildcard); w != nsec {
+				result = append(result, w)
+			}
+		}
+		return result
+	}
+	// closest encloser: the longest ancestor of qName that exists, either
+	// as the owner of the covering NSEC or as an empty non-terminal of it.
+	closest := zm.ZoneConfig.Origin
+	for _, name := range []string{nsec.Hdr.Name, nsec.NextDomain} {
+		for off, end := 0, false; !end; off, end = dns.NextLabel(qName, off) {
+			if len(qName[off:]) <= len(closest) {
+				break
+			}
+			if dns.IsSubDomain(qName[off:], name) {
+				closest = qName[off:]
+				break
+			}
+		}
+	}
+	wildcard := covering("*." + closest)
+	if wildcard != nsec {
+		result = append(result, wildcard)
+	}
+	return result
+}
+
+// covering returns the NSEC record whose owner is name or which covers name.
+func (zm *zoneManager) covering(name string) *dns.NSEC {
+	chain := zm.getNSECChain()
+	i := sort.Search(len(chain), func(i int) bool {
+		return canonicalLess(name, chain[i].Hdr.Name)
+	})
+	if i == 0 {
+		i = len(chain)
+	}
+	return chain[i-1]
+}
+
+// getWildcardName returns the owner name of the wildcard records which are
+// synthesized for fqdn.
+func (zm *zoneManager) getWildcardName(fqdn string) (string, bool) {
+	prefix, err := zm.getPrefixByOrigin(fqdn)
+	if err != nil {
+		return "", false
+	}
+	wildcard, ok := zm.getWildcard(prefix)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%s.%s", wildcard, zm.ZoneConfig.Origin), true
+}
+
+// canonicalLess reports whether a sorts before b in the canonical DNS name
+// order of RFC 4034 section 6.1.
+func canonicalLess(a string, b string) bool {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
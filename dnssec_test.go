@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestZone returns the zone manager of origin serving records.
+func newTestZone(origin string, records map[string][]dnsRecord) *zoneManager {
+	zm := newZoneManager(&zone{
+		Suffix: origin,
+		Origin: origin,
+		TTL:    3600,
+		NS:     []string{"ns1." + origin},
+		SOA: soa{
+			NS:      "ns1." + origin,
+			MBox:    "root." + origin,
+			Refresh: 3600,
+			Retry:   900,
+			Expire:  604800,
+			MinTTL:  300,
+		},
+	})
+	zm.initSerial()
+	tree := newDNSTree()
+	for name, rs := range records {
+		for _, r := range rs {
+			tree.addRecords(name, r)
+		}
+	}
+	tree.index()
+	zm.Tree = *tree
+	zm.Base = *tree
+	return zm
+}
+
+// newTestSigner signs zm with a single generated key.
+func newTestSigner(t *testing.T, zm *zoneManager) {
+	key, err := generateKey(zm.ZoneConfig.Origin, 257, dns.ECDSAP256SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zm.Signer = &zoneSigner{KSK: key, ZSK: key, sigs: map[string]signature{}}
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+func TestCanonicalLess(t *testing.T) {
+	// RFC 4034 section 6.1
+	ordered := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"*.z.example.",
+	}
+	for i := 0; i < len(ordered); i++ {
+		for j := 0; j < len(ordered); j++ {
+			if got := canonicalLess(ordered[i], ordered[j]); got != (i < j) {
+				t.Errorf("canonicalLess(%q, %q) = %v, want %v", ordered[i], ordered[j], got, i < j)
+			}
+		}
+	}
+	if canonicalLess("A.example.", "a.EXAMPLE.") {
+		t.Error("canonicalLess is not case-insensitive")
+	}
+}
+
+func testChainZone() *zoneManager {
+	return newTestZone("example.com.", map[string][]dnsRecord{
+		"":    {{DNSType: dns.TypeA, A: net.ParseIP("192.0.2.1")}},
+		"a":   {{DNSType: dns.TypeA, A: net.ParseIP("192.0.2.2")}},
+		"c":   {{DNSType: dns.TypeTXT, TXT: "c"}},
+		"x.y": {{DNSType: dns.TypeA, A: net.ParseIP("192.0.2.3")}},
+	})
+}
+
+func TestCovering(t *testing.T) {
+	zm := testChainZone()
+	newTestSigner(t, zm)
+	tests := []struct {
+		name  string
+		owner string
+		next  string
+	}{
+		{"example.com.", "example.com.", "a.example.com."},
+		{"0.example.com.", "example.com.", "a.example.com."},
+		{"a.example.com.", "a.example.com.", "c.example.com."},
+		{"B.example.com.", "a.example.com.", "c.example.com."},
+		{"y.example.com.", "c.example.com.", "x.y.example.com."},
+		{"z.example.com.", "x.y.example.com.", "example.com."},
+		{"a.x.y.example.com.", "x.y.example.com.", "example.com."},
+	}
+	for _, tt := range tests {
+		nsec := zm.covering(tt.name)
+		if nsec.Hdr.Name != tt.owner || nsec.NextDomain != tt.next {
+			t.Errorf("covering(%q) = %s -> %s, want %s -> %s", tt.name, nsec.Hdr.Name, nsec.NextDomain, tt.owner, tt.next)
+		}
+	}
+}
+
+func TestDenial(t *testing.T) {
+	zm := testChainZone()
+	newTestSigner(t, zm)
+	tests := []struct {
+		name     string
+		nxdomain bool
+		owners   []string
+	}{
+		// the name and the wildcard of its closest encloser are covered.
+		{"b.example.com.", true, []string{"a.example.com.", "example.com."}},
+		// the wildcard is covered by the same NSEC.
+		{"b.x.y.example.com.", true, []string{"x.y.example.com."}},
+		// no data at the name, which its own NSEC proves.
+		{"a.example.com.", false, []string{"a.example.com."}},
+		{"y.example.com.", false, []string{"c.example.com."}},
+	}
+	for _, tt := range tests {
+		rr := zm.denial(tt.name, tt.nxdomain)
+		owners := []string{}
+		for _, r := range rr {
+			owners = append(owners, r.Header().Name)
+		}
+		if len(owners) != len(tt.owners) {
+			t.Errorf("denial(%q, %v) = %v, want %v", tt.name, tt.nxdomain, owners, tt.owners)
+			continue
+		}
+		for i := range owners {
+			if owners[i] != tt.owners[i] {
+				t.Errorf("denial(%q, %v) = %v, want %v", tt.name, tt.nxdomain, owners, tt.owners)
+				break
+			}
+		}
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	a := mustRR("a.example.com. 3600 IN A 192.0.2.2")
+	tests := []struct {
+		name   string
+		change func(zm *zoneManager)
+		rrset  []dns.RR
+		cached bool
+	}{
+		{"same rrset", func(*zoneManager) {}, []dns.RR{a}, true},
+		{"other case", func(*zoneManager) {}, []dns.RR{mustRR("A.example.com. 3600 IN A 192.0.2.2")}, true},
+		{"other data", func(*zoneManager) {}, []dns.RR{mustRR("a.example.com. 3600 IN A 192.0.2.9")}, false},
+		{"other ttl", func(*zoneManager) {}, []dns.RR{mustRR("a.example.com. 60 IN A 192.0.2.2")}, false},
+		{"new serial", func(zm *zoneManager) { zm.updateSerial() }, []dns.RR{a}, false},
+	}
+	for _, tt := range tests {
+		zm := testChainZone()
+		newTestSigner(t, zm)
+		first, err := zm.sign([]dns.RR{a})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.change(zm)
+		sig, err := zm.sign(tt.rrset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached := sig == first; cached != tt.cached {
+			t.Errorf("%s: cached = %v, want %v", tt.name, cached, tt.cached)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Frame Streams control frames and the dnstap content type.
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmContentType   = 0x01
+
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+)
+
+// dnstap message and socket enums of dnstap.proto.
+const (
+	dnstapTypeMessage      = 1
+	dnstapAuthQuery        = 1
+	dnstapAuthResponse     = 2
+	dnstapSocketFamilyINET = 1
+	dnstapSocketFamilyIPv6 = 2
+)
+
+var dnstapSocketProtocol = map[string]uint64{
+	"udp": 1,
+	"tcp": 2,
+	"tls": 3,
+	"doh": 4,
+}
+
+// dnstapWriter writes dnstap messages as a unidirectional Frame Stream to a
+// file, or as a bidirectional one to the unix socket of a collector such as
+// fstrm_capture. The socket is reconnected when the connection is lost.
+type dnstapWriter struct {
+	identity []byte
+	socket   string
+	conn     io.WriteCloser
+	w        *bufio.Writer
+	lastDial time.Time
+}
+
+func newDnstapWriter(dc *dnstapConfig) (*dnstapWriter, error) {
+	dw := &dnstapWriter{
+		identity: []byte(dc.Identity),
+		socket:   dc.Socket,
+	}
+	if dc.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		dw.identity = []byte(hostname)
+	}
+	switch {
+	case dc.File != "" && dc.Socket != "":
+		return nil, fmt.Errorf("dnstap: either file or socket")
+	case dc.File != "":
+		f, err := os.OpenFile(dc.File, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		dw.conn = f
+		dw.w = bufio.NewWriter(f)
+		if err := writeControlFrame(dw.w, fstrmControlStart); err != nil {
+			return nil, err
+		}
+	case dc.Socket != "":
+		if err := dw.connect(); err != nil {
+			log.Printf("dnstap: %s\n", err)
+		}
+	default:
+		return nil, fmt.Errorf("dnstap: file or socket is required")
+	}
+	return dw, nil
+}
+
+func (dw *dnstapWriter) connect() error {
+	dw.lastDial = time.Now()
+	conn, err := net.DialTimeout("unix", dw.socket, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeControlFrame(conn, fstrmControlReady); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := readAccept(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := writeControlFrame(conn, fstrmControlStart); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	dw.conn = conn
+	dw.w = bufio.NewWriter(conn)
+	return nil
+}
+
+func (dw *dnstapWriter) write(e *queryLogEntry) {
+	if dw.w == nil {
+		if time.Since(dw.lastDial) < time.Second {
+			return
+		}
+		if err := dw.connect(); err != nil {
+			log.Printf("dnstap: %s\n", err)
+			return
+		}
+	}
+	frames := [][]byte{dw.message(e, dnstapAuthQuery)}
+	if e.response != nil {
+		frames = append(frames, dw.message(e, dnstapAuthResponse))
+	}
+	for _, frame := range frames {
+		if frame == nil {
+			continue
+		}
+		if err := writeDataFrame(dw.w, frame); err != nil {
+			dw.fail(err)
+			return
+		}
+	}
+}
+
+func (dw *dnstapWriter) flush() {
+	if dw.w == nil {
+		return
+	}
+	if err := dw.w.Flush(); err != nil {
+		dw.fail(err)
+	}
+}
+
+// close ends the stream with STOP.
+func (dw *dnstapWriter) close() {
+	if dw.w == nil {
+		return
+	}
+	if err := writeControlFrame(dw.w, fstrmControlStop); err == nil {
+		dw.w.Flush()
+	}
+	dw.conn.Close()
+	dw.conn = nil
+	dw.w = nil
+}
+
+func (dw *dnstapWriter) fail(err error) {
+	log.Printf("dnstap: %s\n", err)
+	if dw.socket == "" {
+		return
+	}
+	dw.conn.Close()
+	dw.conn = nil
+	dw.w = nil
+}
+
+// message encodes the Dnstap protobuf of the query or the response of e.
+// The name of the view is given as extra.
+func (dw *dnstapWriter) message(e *queryLogEntry, typ uint64) []byte {
+	msg := pbUint(nil, 1, typ)
+	queryIP, queryPort := addrIPPort(e.remote)
+	responseIP, responsePort := addrIPPort(e.local)
+	if queryIP.To4() != nil {
+		msg = pbUint(msg, 2, dnstapSocketFamilyINET)
+		queryIP, responseIP = queryIP.To4(), responseIP.To4()
+	} else {
+		msg = pbUint(msg, 2, dnstapSocketFamilyIPv6)
+	}
+	if protocol, ok := dnstapSocketProtocol[e.transport]; ok {
+		msg = pbUint(msg, 3, protocol)
+	}
+	msg = pbBytes(msg, 4, queryIP)
+	msg = pbBytes(msg, 5, responseIP)
+	msg = pbUint(msg, 6, uint64(queryPort))
+	msg = pbUint(msg, 7, uint64(responsePort))
+	msg = pbUint(msg, 8, uint64(e.start.Unix()))
+	msg = pbFixed32(msg, 9, uint32(e.start.Nanosecond()))
+	query, err := e.query.Pack()
+	if err != nil {
+		return nil
+	}
+	msg = pbBytes(msg, 10, query)
+	if e.zone != "" {
+		zone := make([]byte, 256)
+		if off, err := dns.PackDomainName(e.zone, zone, 0, nil, false); err == nil {
+			msg = pbBytes(msg, 11, zone[:off])
+		}
+	}
+	if typ == dnstapAuthResponse {
+		response, err := e.response.Pack()
+		if err != nil {
+			return nil
+		}
+		msg = pbUint(msg, 12, uint64(e.end.Unix()))
+		msg = pbFixed32(msg, 13, uint32(e.end.Nanosecond()))
+		msg = pbBytes(msg, 14, response)
+	}
+
+	buf := pbBytes(nil, 1, dw.identity)
+	buf = pbBytes(buf, 2, []byte("nsbox"))
+	if e.view != nil {
+		buf = pbBytes(buf, 3, []byte(e.view.Name))
+	}
+	buf = pbBytes(buf, 14, msg)
+	return pbUint(buf, 15, dnstapTypeMessage)
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return net.IPv6zero, 0
+}
+
+func writeDataFrame(w io.Writer, frame []byte) error {
+	buf := make([]byte, 4, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	_, err := w.Write(append(buf, frame...))
+	return err
+}
+
+// writeControlFrame writes a control frame, along with the content type
+// unless it is STOP.
+func writeControlFrame(w io.Writer, typ uint32) error {
+	control := make([]byte, 4)
+	binary.BigEndian.PutUint32(control, typ)
+	if typ != fstrmControlStop {
+		field := make([]byte, 8)
+		binary.BigEndian.PutUint32(field, fstrmContentType)
+		binary.BigEndian.PutUint32(field[4:], uint32(len(dnstapContentType)))
+		control = append(append(control, field...), dnstapContentType...)
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(control)))
+	_, err := w.Write(append(buf, control...))
+	return err
+}
+
+func readAccept(r io.Reader) error {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(head[4:])
+	if binary.BigEndian.Uint32(head) != 0 || length < 4 || length > 512 {
+		return fmt.Errorf("invalid control frame")
+	}
+	control := make([]byte, length)
+	if _, err := io.ReadFull(r, control); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(control) != fstrmControlAccept {
+		return fmt.Errorf("unexpected control frame")
+	}
+	return nil
+}
+
+func pbKey(b []byte, field, wireType uint64) []byte {
+	return pbVarint(b, field<<3|wireType)
+}
+
+func pbVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func pbUint(b []byte, field, v uint64) []byte {
+	return pbVarint(pbKey(b, field, 0), v)
+}
+
+func pbFixed32(b []byte, field uint64, v uint32) []byte {
+	b = pbKey(b, field, 5)
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, v)
+	return append(b, buf...)
+}
+
+func pbBytes(b []byte, field uint64, v []byte) []byte {
+	b = pbVarint(pbKey(b, field, 2), uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dohMediaType = "application/dns-message"
+
+// dohHandler serves DNS over HTTPS (RFC 8484), passing the queries to the
+// same handler as the DNS listeners.
+type dohHandler struct {
+	handler dns.Handler
+	keys    tsigKeys
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err == nil {
+		err = req.Unpack(buf)
+	}
+	if err != nil || len(req.Question) != 1 {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+	rw, err := newDoHResponseWriter(r, h.keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tsig := req.IsTsig(); tsig != nil {
+		rw.requestMAC = tsig.MAC
+		rw.tsigStatus = dns.TsigVerifyWithProvider(buf, h.keys, "", false)
+	}
+	switch req.Question[0].Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		// a transfer takes more than one message.
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNotImplemented)
+		rw.WriteMsg(m)
+	default:
+		h.handler.ServeDNS(rw, req)
+	}
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	if ttl, ok := minTTL(rw.msg); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(rw.msg)
+}
+
+// minTTL returns the smallest TTL of the records in buf, which is the
+// freshness lifetime of the response (RFC 8484 5.1).
+func minTTL(buf []byte) (uint32, bool) {
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return 0, false
+	}
+	ttl, ok := uint32(0), false
+	for _, rr := range append(append(m.Answer, m.Ns...), m.Extra...) {
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT, dns.TypeTSIG:
+			continue
+		}
+		if !ok || rr.Header().Ttl < ttl {
+			ttl, ok = rr.Header().Ttl, true
+		}
+	}
+	return ttl, ok
+}
+
+// dohResponseWriter is the dns.ResponseWriter of a DoH request, which keeps
+// the response to be written to the http response.
+type dohResponseWriter struct {
+	local      net.Addr
+	remote     net.Addr
+	keys       tsigKeys
+	tsigStatus error
+	requestMAC string
+	msg        []byte
+}
+
+func newDoHResponseWriter(r *http.Request, keys tsigKeys) (*dohResponseWriter, error) {
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return nil, fmt.Errorf("unknown local address")
+	}
+	return &dohResponseWriter{local: local, remote: remote, keys: keys}, nil
+}
+
+func (rw *dohResponseWriter) LocalAddr() net.Addr {
+	return rw.local
+}
+
+func (rw *dohResponseWriter) RemoteAddr() net.Addr {
+	return rw.remote
+}
+
+func (rw *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsTsig() != nil {
+		buf, _, err := dns.TsigGenerateWithProvider(m, rw.keys, rw.requestMAC, false)
+		if err != nil {
+			return err
+		}
+		rw.msg = buf
+		return nil
+	}
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	rw.msg = buf
+	return nil
+}
+
+func (rw *dohResponseWriter) Write(buf []byte) (int, error) {
+	rw.msg = append([]byte{}, buf...)
+	return len(buf), nil
+}
+
+func (rw *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (rw *dohResponseWriter) TsigStatus() error {
+	return rw.tsigStatus
+}
+
+func (rw *dohResponseWriter) TsigTimersOnly(bool) {}
+
+func (rw *dohResponseWriter) Hijack() {}
+
+// serveDoH starts the own listener of the DoH endpoint.
+func serveDoH(dc *dohConfig, handler http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle(dc.Path, handler)
+	srv := &http.Server{
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		Addr:         dc.Listen,
+		Handler:      mux,
+	}
+	if dc.Cert != "" {
+		tlsConfig, err := newTLSConfig(&tlsConfig{Cert: dc.Cert, Key: dc.Key})
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		srv.TLSConfig = tlsConfig
+	}
+	for {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		log.Println(err)
+		time.Sleep(retry)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha512"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// maxUDPSize is the EDNS0 payload size advertised to clients and the upper
+// bound of UDP responses.
+var maxUDPSize uint16 = 4096
+
+// checkEdns validates the OPT record of r (RFC 6891 6.1.1) and returns the
+// rcode of the error response, or dns.RcodeSuccess.
+func checkEdns(r *dns.Msg) int {
+	for _, rr := range append(r.Answer, r.Ns...) {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			return dns.RcodeFormatError
+		}
+	}
+	opts := 0
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			continue
+		}
+		opts++
+		if opts > 1 || rr.Header().Name != "." {
+			return dns.RcodeFormatError
+		}
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		return dns.RcodeBadVers
+	}
+	if ecs := clientSubnet(r); ecs != nil {
+		// the scope is set by the server and the address must not have
+		// bits beyond the source prefix (RFC 7871 7.1.2).
+		bits := net.IPv6len * 8
+		address := ecs.Address
+		if ecs.Family == 1 {
+			bits = net.IPv4len * 8
+			address = address.To4()
+		}
+		if ecs.SourceScope != 0 || !address.Equal(address.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits))) {
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// clientSubnet returns the EDNS Client Subnet option of r (RFC 7871).
+func clientSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// trustedResolvers are the networks of the resolvers whose ECS option is
+// honoured. The option of other clients is echoed with a scope of 0.
+var trustedResolvers []*net.IPNet
+
+// trustedSubnet returns the ECS option of r when the client is a trusted
+// resolver.
+func trustedSubnet(w dns.ResponseWriter, r *dns.Msg) *dns.EDNS0_SUBNET {
+	ecs := clientSubnet(r)
+	if ecs == nil {
+		return nil
+	}
+	ip, err := parseIP(w.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	for _, trusted := range trustedResolvers {
+		if trusted.Contains(ip) {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// clientIP returns the address of the client of r, which is the client
+// subnet of a trusted resolver using ECS or the remote address otherwise.
+func clientIP(w dns.ResponseWriter, r *dns.Msg) net.IP {
+	if ecs := trustedSubnet(w, r); ecs != nil && ecs.SourceNetmask != 0 {
+		return ecs.Address
+	}
+	ip, err := parseIP(w.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return ip
+}
+
+// setClientSubnet echoes the ECS option of r in m. The scope prefix length
+// is the source prefix length when the answer depends on the client subnet of
+// a trusted resolver, that is when views are configured or addresses of the
+// family of the client were ordered, and 0 otherwise.
+func setClientSubnet(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	ecs := clientSubnet(r)
+	opt := m.IsEdns0()
+	if ecs == nil || opt == nil {
+		return
+	}
+	scope := uint8(0)
+	if trustedSubnet(w, r) != nil {
+		if len(views) != 0 {
+			scope = ecs.SourceNetmask
+		}
+		for _, rr := range m.Answer {
+			t := rr.Header().Rrtype
+			if t == dns.TypeA && ecs.Family == 1 || t == dns.TypeAAAA && ecs.Family == 2 {
+				scope = ecs.SourceNetmask
+			}
+		}
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ecs.Family,
+		SourceNetmask: ecs.SourceNetmask,
+		SourceScope:   scope,
+		Address:       ecs.Address,
+	})
+}
+
+// setEdns adds an OPT record to m when the client sent one, echoing its DO
+// bit.
+func setEdns(r *dns.Msg, m *dns.Msg) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+	m.SetEdns0(maxUDPSize, opt.Do())
+}
+
+// udpSize returns the largest UDP response the client of r accepts.
+func udpSize(r *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		size = int(opt.UDPSize())
+	}
+	if size > int(maxUDPSize) {
+		size = int(maxUDPSize)
+	}
+	return size
+}
+
+// truncate trims m to the UDP payload size of r and sets the TC bit when it
+// does not fit.
+func truncate(r *dns.Msg, m *dns.Msg) {
+	size := udpSize(r)
+	tsig := m.IsTsig()
+	if tsig == nil {
+		m.Truncate(size)
+		return
+	}
+	// dns.Msg.Truncate leaves signed messages alone, so the TSIG record is
+	// put aside with room for the largest MAC.
+	limit := size - dns.Len(tsig) - sha512.Size
+	m.Extra = m.Extra[:len(m.Extra)-1]
+	m.Truncate(limit)
+	// dns.Msg.Truncate keeps dns.MinMsgSize at least, which leaves no room
+	// for the TSIG record of small clients.
+	for m.Len() > limit {
+		if len(m.Ns) != 0 {
+			m.Ns = m.Ns[:len(m.Ns)-1]
+		} else if len(m.Answer) != 0 {
+			m.Answer = m.Answer[:len(m.Answer)-1]
+		} else {
+			break
+		}
+		m.Truncated = true
+	}
+	m.Extra = append(m.Extra, tsig)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name      string
+		answers   int
+		edns      uint16
+		tsig      bool
+		truncated bool
+	}{
+		{"fits", 2, 0, false, false},
+		{"fits signed", 2, 0, true, false},
+		{"too large", 50, 0, false, true},
+		{"too large signed", 50, 0, true, true},
+		{"fits edns", 50, 4096, false, false},
+		{"fits edns signed", 50, 4096, true, false},
+		{"too large edns signed", 500, 4096, true, true},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion("a.example.com.", dns.TypeTXT)
+		if tt.edns != 0 {
+			r.SetEdns0(tt.edns, false)
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for i := 0; i < tt.answers; i++ {
+			m.Answer = append(m.Answer, mustRR(fmt.Sprintf("a.example.com. 3600 IN TXT \"record %d of the answer\"", i)))
+		}
+		if tt.tsig {
+			m.SetTsig("key.", dns.HmacSHA256, 300, 0)
+		}
+		truncate(r, m)
+		if m.Truncated != tt.truncated {
+			t.Errorf("%s: truncated = %v, want %v", tt.name, m.Truncated, tt.truncated)
+		}
+		if tt.tsig && m.IsTsig() == nil {
+			t.Errorf("%s: TSIG record dropped", tt.name)
+		}
+		// the MAC is added on the wire.
+		size := m.Len()
+		if tt.tsig {
+			size += sha512.Size
+		}
+		if size > udpSize(r) {
+			t.Errorf("%s: %d bytes exceed %d", tt.name, size, udpSize(r))
+		}
+	}
+}
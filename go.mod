@@ -5,6 +5,6 @@ go 1.13
 require (
 	github.com/go-resty/resty/v2 v2.1.0
 	github.com/google/go-cmp v0.3.1
-	github.com/miekg/dns v1.1.25
+	github.com/miekg/dns v1.1.50
 	gopkg.in/yaml.v2 v2.2.7
 )
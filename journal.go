@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+type journalEntry struct {
+	From    uint32   `yaml:"from"`
+	To      uint32   `yaml:"to"`
+	Deleted []string `yaml:"deleted"`
+	Added   []string `yaml:"added"`
+}
+
+// addJournal records the difference between oldTree and newTree as the
+// change from serial from to the current serial, keeping at most size
+// entries.
+func (zm *zoneManager) addJournal(from uint32, oldTree *dnsTree, newTree *dnsTree, size int) {
+	oldRR := map[string]bool{}
+	for _, rr := range zm.treeRRs(oldTree) {
+		oldRR[rr.String()] = true
+	}
+	newRR := map[string]bool{}
+	for _, rr := range zm.treeRRs(newTree) {
+		newRR[rr.String()] = true
+	}
+	entry := journalEntry{
+		From:    from,
+		To:      zm.getSerial(),
+		Deleted: []string{},
+		Added:   []string{},
+	}
+	for rr := range oldRR {
+		if !newRR[rr] {
+			entry.Deleted = append(entry.Deleted, rr)
+		}
+	}
+	for rr := range newRR {
+		if !oldRR[rr] {
+			entry.Added = append(entry.Added, rr)
+		}
+	}
+	sort.Strings(entry.Deleted)
+	sort.Strings(entry.Added)
+	zm.Journal = append(zm.Journal, entry)
+	if len(zm.Journal) > size {
+		zm.Journal = zm.Journal[len(zm.Journal)-size:]
+	}
+}
+
+// getIXFR returns the incremental transfer from serial to the current serial,
+// or nil when the journal does not reach back to serial.
+func (zm *zoneManager) getIXFR(serial uint32) []dns.RR {
+	if zm.Signer != nil {
+		// signatures are created on the fly, so there is nothing to diff.
+		return nil
+	}
+	soa, err := zm.getSOA(zm.ZoneConfig.Origin)
+	if err != nil {
+		return nil
+	}
+	start := -1
+	for i, entry := range zm.Journal {
+		if entry.From == serial {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	rr := []dns.RR{soa}
+	current := serial
+	for _, entry := range zm.Journal[start:] {
+		if entry.From != current {
+			return nil
+		}
+		fromSOA := *soa
+		fromSOA.Serial = entry.From
+		toSOA := *soa
+		toSOA.Serial = entry.To
+		rr = append(rr, &fromSOA)
+		for _, s := range entry.Deleted {
+			_rr, err := dns.NewRR(s)
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			rr = append(rr, _rr)
+		}
+		rr = append(rr, &toSOA)
+		for _, s := range entry.Added {
+			_rr, err := dns.NewRR(s)
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			rr = append(rr, _rr)
+		}
+		current = entry.To
+	}
+	if current != soa.Serial {
+		return nil
+	}
+	return append(rr, soa)
+}
+
+// serialLess compares serial numbers using RFC 1982 arithmetic.
+func serialLess(a uint32, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSerialLess(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{2026101699, 2026101701, true},
+		{0xffffffff, 0, true},
+		{0, 0xffffffff, false},
+		{0xfffffff0, 0x10, true},
+		{0, 0x7fffffff, true},
+		// the distance of 2^31 is undefined and compares in neither order.
+		{0, 0x80000000, false},
+		{0x80000000, 0, false},
+	}
+	for _, tt := range tests {
+		if got := serialLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("serialLess(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestGetIXFR(t *testing.T) {
+	journal := []journalEntry{
+		{From: 2026101601, To: 2026101602, Deleted: []string{}, Added: []string{"a.example.com.\t3600\tIN\tA\t192.0.2.1"}},
+		{From: 2026101602, To: 2026101603, Deleted: []string{"a.example.com.\t3600\tIN\tA\t192.0.2.1"}, Added: []string{"b.example.com.\t3600\tIN\tA\t192.0.2.2"}},
+	}
+	tests := []struct {
+		name    string
+		journal []journalEntry
+		serial  uint32
+		signed  bool
+		want    []string
+	}{
+		{"two changes", journal, 2026101601, false, []string{
+			"SOA 2026101603",
+			"SOA 2026101601",
+			"SOA 2026101602",
+			"a.example.com.\t3600\tIN\tA\t192.0.2.1",
+			"SOA 2026101602",
+			"a.example.com.\t3600\tIN\tA\t192.0.2.1",
+			"SOA 2026101603",
+			"b.example.com.\t3600\tIN\tA\t192.0.2.2",
+			"SOA 2026101603",
+		}},
+		{"last change", journal, 2026101602, false, []string{
+			"SOA 2026101603",
+			"SOA 2026101602",
+			"a.example.com.\t3600\tIN\tA\t192.0.2.1",
+			"SOA 2026101603",
+			"b.example.com.\t3600\tIN\tA\t192.0.2.2",
+			"SOA 2026101603",
+		}},
+		{"unknown serial", journal, 2026101600, false, nil},
+		{"current serial", journal, 2026101603, false, nil},
+		{"gap", []journalEntry{journal[0], {From: 2026101605, To: 2026101603}}, 2026101601, false, nil},
+		{"behind the zone", journal[:1], 2026101601, false, nil},
+		{"signed", journal, 2026101601, true, nil},
+	}
+	for _, tt := range tests {
+		zm := newTestZone("example.com.", nil)
+		zm.setSerial(2026101603)
+		zm.Journal = tt.journal
+		if tt.signed {
+			newTestSigner(t, zm)
+		}
+		var got []string
+		for _, r := range zm.getIXFR(tt.serial) {
+			if soa, ok := r.(*dns.SOA); ok {
+				got = append(got, fmt.Sprintf("SOA %d", soa.Serial))
+			} else {
+				got = append(got, r.String())
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: getIXFR(%d) = %q, want %q", tt.name, tt.serial, got, tt.want)
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"syscall"
 
 	"github.com/miekg/dns"
@@ -17,6 +20,9 @@ import (
 var (
 	configPath = flag.String("c", "./config.yml", "path of configuration file")
 	config     = &Config{
+		DataStore: dataStoreConfig{
+			JournalSize: 100,
+		},
 		Netbox: netboxConfig{
 			UseTLS:    false,
 			VerifyTLS: true,
@@ -26,13 +32,77 @@ var (
 	}
 )
 
-func serve(net string, listen string, secret *map[string]string, soreuseport bool) {
-	server := &dns.Server{Addr: listen, Net: net, TsigSecret: *secret, ReusePort: soreuseport}
+func serve(net string, listen string, handler dns.Handler, tlsConfig *tls.Config, keys tsigKeys, soreuseport bool) {
+	server := &dns.Server{Addr: listen, Net: net, Handler: handler, TLSConfig: tlsConfig, TsigProvider: keys, ReusePort: soreuseport, MsgAcceptFunc: msgAcceptFunc}
 	if err := server.ListenAndServe(); err != nil {
 		log.Printf("Failed to setup the "+net+" server: %s\n", err.Error())
 	}
 }
 
+// msgAcceptFunc extends dns.DefaultMsgAcceptFunc to accept dynamic updates,
+// which carry records in every section.
+func msgAcceptFunc(dh dns.Header) dns.MsgAcceptAction {
+	isResponse := dh.Bits&(1<<15) != 0
+	opcode := int(dh.Bits>>11) & 0xF
+	if !isResponse && opcode == dns.OpcodeUpdate {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// zoneMux passes queries to dns.DefaultServeMux and refuses names outside
+// of every zone, which the mux would answer with SERVFAIL. It holds the
+// zones by origin.
+type zoneMux map[string]viewSelector
+
+// authoritative are the zones of nsbox.
+var authoritative = zoneMux{}
+
+func (mux zoneMux) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if _, root := mux["."]; len(r.Question) == 1 && !root {
+		if !mux.hasZone(r.Question[0].Name) {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			setEdns(r, m)
+			writeLimited(w, r, m)
+			return
+		}
+	}
+	dns.DefaultServeMux.ServeDNS(w, r)
+}
+
+// zone returns the zone of the view v with the closest origin enclosing
+// name.
+func (mux zoneMux) zone(name string, v *view) (*zoneManager, bool) {
+	selector, ok := mux.selector(name)
+	if !ok {
+		return nil, false
+	}
+	zm, ok := selector[v]
+	return zm, ok
+}
+
+// hasZone reports whether name is in a zone of any view.
+func (mux zoneMux) hasZone(name string) bool {
+	_, ok := mux.selector(name)
+	return ok
+}
+
+// selector returns the views of the zone with the closest origin enclosing
+// name.
+func (mux zoneMux) selector(name string) (viewSelector, bool) {
+	name = strings.ToLower(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if selector, ok := mux[name[off:]]; ok {
+			return selector, true
+		}
+	}
+	return nil, false
+}
+
 func main() {
 	flag.Usage = func() {
 		flag.PrintDefaults()
@@ -61,40 +131,138 @@ func main() {
 		runtime.GOMAXPROCS(*config.Server.CPU)
 	}
 
+	if config.DataStore.JournalSize < 0 {
+		log.Fatal("dataStore.journalSize must not be negative")
+	}
+
+	views, err = parseViews(config.Views)
+	if err != nil {
+		log.Fatal(err)
+	}
+	trustedResolvers, err = parseNetworks(config.Server.TrustedResolvers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.Server.RateLimit != nil {
+		limiter, err = newRateLimiter(config.Server.RateLimit)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	zoneViews := append([]*view{}, views...)
+	if len(zoneViews) == 0 {
+		zoneViews = []*view{nil}
+	}
+
 	zms := map[string]*zoneManager{}
+	mux := authoritative
 	for _, zoneConfig := range config.Zones {
 		zone, err := zoneMerge(&zoneConfig, &config.ZoneDefault)
 		if err != nil {
 			log.Fatal(err)
 		}
-		zm := newZoneManager(zone)
-		dns.HandleFunc(zone.Origin, zm.handler)
-		zms[zm.ZoneConfig.Suffix] = zm
+		selector := viewSelector{}
+		for _, v := range zoneViews {
+			viewZone := *zone
+			viewZone.View = v
+			zm := newZoneManager(&viewZone)
+			if zone.DNSSEC != nil {
+				signer, err := newZoneSigner(&viewZone)
+				if err != nil {
+					log.Fatal(err)
+				}
+				zm.Signer = signer
+			}
+			selector[v] = zm
+			zms[zm.name()] = zm
+		}
+		dns.HandleFunc(zone.Origin, selector.handler)
+		mux[strings.ToLower(zone.Origin)] = selector
+	}
+
+	var handler dns.Handler = mux
+	var ql *queryLog
+	if config.QueryLog != nil || config.Metrics != nil {
+		ql, err = newQueryLog(config.QueryLog, mux, config.Metrics != nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = ql
 	}
 
-	if err := startNetboxSync(config, &zms); err != nil {
+	keys, err := newTsigKeys(config.TsigSecrets)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	secret := map[string]string{}
-	for _, ts := range config.TsigSecrets {
-		secret[dns.Fqdn(ts.Name)] = ts.Secret
+	webhookHandlers := map[string]http.Handler{}
+	if dc := config.Server.DoH; dc != nil {
+		if dc.Path == "" {
+			dc.Path = "/dns-query"
+		}
+		doh := &dohHandler{handler: handler, keys: keys}
+		if dc.Webhook {
+			webhookHandlers[dc.Path] = doh
+		}
+		if dc.Listen != "" {
+			go serveDoH(dc, doh)
+		}
+	}
+
+	if mc := config.Metrics; mc != nil {
+		if mc.Path == "" {
+			mc.Path = "/metrics"
+		}
+		metrics := &metricsHandler{zms: zms}
+		if mc.Webhook {
+			webhookHandlers[mc.Path] = metrics
+		}
+		if mc.Listen != "" {
+			go serveMetrics(mc, metrics)
+		}
+	}
+
+	if err := startNetboxSync(config, &zms, webhookHandlers); err != nil {
+		log.Fatal(err)
+	}
+
+	var tlsConfig *tls.Config
+	tlsListen := []string{}
+	if config.Server.TLS != nil {
+		tlsConfig, err = newTLSConfig(config.Server.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// client certificates authenticate zone transfers (XoT).
+		tlsConfig.ClientAuth = tls.RequestClientCert
+		tlsConfig.NextProtos = []string{"dot"}
+		tlsListen = config.Server.TLS.Listen
 	}
 	if config.Server.SoReuseport != nil {
 		for i := uint32(0); i < *config.Server.SoReuseport; i++ {
 			for _, listen := range config.Server.Listen {
-				go serve("tcp", listen, &secret, true)
-				go serve("udp", listen, &secret, true)
+				go serve("tcp", listen, handler, nil, keys, true)
+				go serve("udp", listen, handler, nil, keys, true)
+			}
+			for _, listen := range tlsListen {
+				go serve("tcp-tls", listen, handler, tlsConfig, keys, true)
 			}
 		}
 	} else {
 		for _, listen := range config.Server.Listen {
-			go serve("tcp", listen, &secret, false)
-			go serve("udp", listen, &secret, false)
+			go serve("tcp", listen, handler, nil, keys, false)
+			go serve("udp", listen, handler, nil, keys, false)
+		}
+		for _, listen := range tlsListen {
+			go serve("tcp-tls", listen, handler, tlsConfig, keys, false)
 		}
 	}
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	s := <-sig
 	log.Printf("Signal (%s) received, stopping\n", s)
+	if ql != nil {
+		ql.close()
+	}
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Metrics exposed on /metrics in the Prometheus text format.
+var (
+	queriesTotal = newMetricVec("nsbox_dns_queries_total", "counter",
+		"DNS queries by zone, view, qtype, rcode and transport.",
+		"zone", "view", "qtype", "rcode", "transport")
+	requestDuration = newHistogramVec("nsbox_dns_request_duration_seconds",
+		"Time to answer a DNS query.",
+		[]float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		"transport")
+	transfersTotal = newMetricVec("nsbox_dns_transfers_total", "counter",
+		"Zone transfers sent by zone, view and type.",
+		"zone", "view", "type")
+	netboxSyncDuration = newHistogramVec("nsbox_netbox_sync_duration_seconds",
+		"Duration of successful netbox syncs.",
+		[]float64{.1, .25, .5, 1, 2.5, 5, 10, 25, 60, 120})
+	netboxSyncFailures = newMetricVec("nsbox_netbox_sync_failures_total", "counter",
+		"Failed netbox syncs.")
+	netboxPagesFetched = newMetricVec("nsbox_netbox_pages_fetched_total", "counter",
+		"Pages fetched from netbox by endpoint.",
+		"path")
+	netboxLastSync = newMetricVec("nsbox_netbox_last_sync_success_timestamp_seconds", "gauge",
+		"Unix time of the last successful netbox sync.")
+	webhookTriggers = newMetricVec("nsbox_webhook_triggers_total", "counter",
+		"Webhooks received.")
+)
+
+// metricVec is a counter or gauge with labels.
+type metricVec struct {
+	name   string
+	typ    string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labels []string
+	value  float64
+}
+
+func newMetricVec(name, typ, help string, labels ...string) *metricVec {
+	mv := &metricVec{
+		name:   name,
+		typ:    typ,
+		help:   help,
+		labels: labels,
+		values: map[string]*metricValue{},
+	}
+	if len(labels) == 0 {
+		// exposed as zero from the start.
+		mv.get(nil)
+	}
+	return mv
+}
+
+func (mv *metricVec) get(labels []string) *metricValue {
+	key := strings.Join(labels, "\xff")
+	v, ok := mv.values[key]
+	if !ok {
+		v = &metricValue{labels: labels}
+		mv.values[key] = v
+	}
+	return v
+}
+
+func (mv *metricVec) add(value float64, labels ...string) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	mv.get(labels).value += value
+}
+
+func (mv *metricVec) set(value float64, labels ...string) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	mv.get(labels).value = value
+}
+
+func (mv *metricVec) write(w io.Writer) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", mv.name, mv.help, mv.name, mv.typ)
+	for _, key := range sortedKeys(mv.values) {
+		v := mv.values[key]
+		fmt.Fprintf(w, "%s%s %g\n", mv.name, formatLabels(mv.labels, v.labels, ""), v.value)
+	}
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogramValue{},
+	}
+}
+
+func (hv *histogramVec) observe(value float64, labels ...string) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	key := strings.Join(labels, "\xff")
+	v, ok := hv.values[key]
+	if !ok {
+		v = &histogramValue{labels: labels, counts: make([]uint64, len(hv.buckets))}
+		hv.values[key] = v
+	}
+	for i, le := range hv.buckets {
+		if value <= le {
+			v.counts[i]++
+		}
+	}
+	v.sum += value
+	v.count++
+}
+
+func (hv *histogramVec) write(w io.Writer) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", hv.name, hv.help, hv.name)
+	for _, key := range sortedKeys(hv.values) {
+		v := hv.values[key]
+		for i, le := range hv.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, formatLabels(hv.labels, v.labels, fmt.Sprint(le)), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, formatLabels(hv.labels, v.labels, "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", hv.name, formatLabels(hv.labels, v.labels, ""), v.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, formatLabels(hv.labels, v.labels, ""), v.count)
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch values := m.(type) {
+	case map[string]*metricValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns {name="value",...}, with the le label of histogram
+// buckets unless it is empty.
+func formatLabels(names []string, values []string, le string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// observeQuery accounts a query of the query log.
+func observeQuery(e *queryLogEntry) {
+	qtype, rcode := "", "NONE"
+	if len(e.query.Question) != 0 {
+		// unknown types would let clients create any number of series.
+		var ok bool
+		if qtype, ok = dns.TypeToString[e.query.Question[0].Qtype]; !ok {
+			qtype = "other"
+		}
+	}
+	if e.response != nil {
+		rcode = dns.RcodeToString[e.response.Rcode]
+		requestDuration.observe(e.end.Sub(e.start).Seconds(), e.transport)
+	}
+	queriesTotal.add(1, e.zone, viewName(e.view), qtype, rcode, e.transport)
+}
+
+func viewName(v *view) string {
+	if v == nil {
+		return ""
+	}
+	return v.Name
+}
+
+// metricsHandler serves the metrics along with the records and the serial
+// of every zone.
+type metricsHandler struct {
+	zms map[string]*zoneManager
+}
+
+func (mh *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	records := newMetricVec("nsbox_zone_records", "gauge",
+		"Records served by zone and view.",
+		"zone", "view")
+	serials := newMetricVec("nsbox_zone_serial", "gauge",
+		"Current serial by zone and view.",
+		"zone", "view")
+	for _, zm := range mh.zms {
+		zm.mu.RLock()
+		count := 0
+		for _, rr := range zm.Tree.Records {
+			count += len(rr)
+		}
+		serial := zm.getSerial()
+		zm.mu.RUnlock()
+		records.set(float64(count), zm.ZoneConfig.Origin, viewName(zm.ZoneConfig.View))
+		serials.set(float64(serial), zm.ZoneConfig.Origin, viewName(zm.ZoneConfig.View))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	queriesTotal.write(w)
+	requestDuration.write(w)
+	transfersTotal.write(w)
+	records.write(w)
+	serials.write(w)
+	netboxSyncDuration.write(w)
+	netboxSyncFailures.write(w)
+	netboxPagesFetched.write(w)
+	netboxLastSync.write(w)
+	webhookTriggers.write(w)
+}
+
+func serveMetrics(mc *metricsConfig, handler http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle(mc.Path, handler)
+	srv := &http.Server{
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		Addr:         mc.Listen,
+		Handler:      mux,
+	}
+	for {
+		err := srv.ListenAndServe()
+		log.Println(err)
+		time.Sleep(retry)
+	}
+}
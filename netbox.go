@@ -19,12 +19,57 @@ import (
 )
 
 type ipAddressResp struct {
-	Next    *string `json:"next"`
-	Results []struct {
-		Address     string `json:"address"`
-		Description string `json:"description"`
-		DNS         string `json:"dns_name"`
-	} `json:"results"`
+	Next    *string     `json:"next"`
+	Results []ipAddress `json:"results"`
+}
+
+type ipAddress struct {
+	ID          int    `json:"id"`
+	Address     string `json:"address"`
+	Description string `json:"description"`
+	DNS         string `json:"dns_name"`
+	VRF         *struct {
+		Name string `json:"name"`
+		RD   string `json:"rd"`
+	} `json:"vrf"`
+	Tags []netboxTag `json:"tags"`
+}
+
+type netboxTag struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+// UnmarshalJSON also accepts the plain string tags of netbox < 2.9.
+func (tag *netboxTag) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		tag.Name, tag.Slug = name, name
+		return nil
+	}
+	type plain netboxTag
+	return json.Unmarshal(b, (*plain)(tag))
+}
+
+type serviceResp struct {
+	Next    *string   `json:"next"`
+	Results []service `json:"results"`
+}
+
+type service struct {
+	Name   string `json:"name"`
+	Device *struct {
+		Name string `json:"name"`
+	} `json:"device"`
+	VirtualMachine *struct {
+		Name string `json:"name"`
+	} `json:"virtual_machine"`
+	Protocol struct {
+		Label string `json:"label"`
+	} `json:"protocol"`
+	// netbox < 3.0 has a single port, later versions a list of ports.
+	Port  *uint16  `json:"port"`
+	Ports []uint16 `json:"ports"`
 }
 
 func newDNSTree() *dnsTree {
@@ -35,6 +80,70 @@ func newDNSTree() *dnsTree {
 
 type dnsTree struct {
 	Records map[string][]dnsRecord `yaml:"records"`
+
+	// names holds every owner name and empty non-terminal, see index.
+	names map[string]bool
+}
+
+// index records the owner names and their ancestors, so that hasName does
+// not need to walk the whole tree. It must be called before the tree is
+// shared with the handlers.
+func (tree *dnsTree) index() {
+	names := map[string]bool{"": true}
+	for prefix := range tree.Records {
+		for off, end := 0, prefix == ""; !end; off, end = dns.NextLabel(prefix, off) {
+			names[prefix[off:]] = true
+		}
+	}
+	tree.names = names
+}
+
+// hasName reports whether prefix is an owner name or an empty non-terminal.
+func (tree *dnsTree) hasName(prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	if tree.names != nil {
+		return tree.names[prefix]
+	}
+	if _, ok := tree.Records[prefix]; ok {
+		return true
+	}
+	for name := range tree.Records {
+		if strings.HasSuffix(name, "."+prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tree *dnsTree) hasRecord(name string, r dnsRecord) bool {
+	for _, record := range tree.Records[name] {
+		if recordEqual(record, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeRecords deletes the records at name matching match and reports
+// whether anything was deleted.
+func (tree *dnsTree) removeRecords(name string, match func(dnsRecord) bool) bool {
+	records := []dnsRecord{}
+	for _, record := range tree.Records[name] {
+		if !match(record) {
+			records = append(records, record)
+		}
+	}
+	if len(records) == len(tree.Records[name]) {
+		return false
+	}
+	if len(records) == 0 {
+		delete(tree.Records, name)
+	} else {
+		tree.Records[name] = records
+	}
+	return true
 }
 
 func (tree *dnsTree) addRecords(name string, r dnsRecord) {
@@ -46,16 +155,33 @@ func (tree *dnsTree) addRecords(name string, r dnsRecord) {
 }
 
 type dnsRecord struct {
-	DNSType uint16 `yaml:"dnsType,omitempty"`
-	A       net.IP `yaml:"a,omitempty"`
-	AAAA    net.IP `yaml:"aaaa,omitempty"`
-	CNAME   string `yaml:"cname,omitempty"`
-	TXT     string `yaml:"txt,omitempty"`
+	DNSType uint16    `yaml:"dnsType,omitempty"`
+	A       net.IP    `yaml:"a,omitempty"`
+	AAAA    net.IP    `yaml:"aaaa,omitempty"`
+	CNAME   string    `yaml:"cname,omitempty"`
+	TXT     string    `yaml:"txt,omitempty"`
+	PTR     string    `yaml:"ptr,omitempty"`
+	NS      string    `yaml:"ns,omitempty"`
+	MX      mxRecord  `yaml:"mx,omitempty"`
+	SRV     srvRecord `yaml:"srv,omitempty"`
+	ALIAS   string    `yaml:"alias,omitempty"`
+}
+
+type srvRecord struct {
+	Priority uint16 `yaml:"priority"`
+	Weight   uint16 `yaml:"weight"`
+	Port     uint16 `yaml:"port"`
+	Target   string `yaml:"target"`
+}
+
+type mxRecord struct {
+	Preference uint16 `yaml:"preference"`
+	Exchange   string `yaml:"exchange"`
 }
 
 var limit = 1000
 
-func startNetboxSync(config *Config, zms *map[string]*zoneManager) error {
+func startNetboxSync(config *Config, zms *map[string]*zoneManager, webhookHandlers map[string]http.Handler) error {
 	interval, err := time.ParseDuration(config.Netbox.Interval)
 	if err != nil {
 		return err
@@ -66,19 +192,27 @@ func startNetboxSync(config *Config, zms *map[string]*zoneManager) error {
 		}
 		ds := getDataStore(&config.DataStore, zms)
 		if ds != nil {
-			for suffix, zm := range *zms {
-				zd, err := ds.getZone(zm.ZoneConfig.Suffix)
-				if err == nil {
+			for _, zm := range *zms {
+				zd, err := ds.getZone(zm.name())
+				zm.mu.Lock()
+				if err == nil && zd.Tree != nil {
+					zd.Tree.index()
 					zm.Tree = *zd.Tree
 					zm.setSerial(zd.Serial)
+					zm.Journal = zd.Journal
+					if zd.Dynamic != nil {
+						zm.Dynamic = *zd.Dynamic
+					}
+					zm.Base = *baseTree(zd)
 				}
-				(*zms)[suffix] = zm
+				zm.DataStore = ds
+				zm.mu.Unlock()
 			}
 		}
 		go syncNetbox(config, zms, ds)
 		if config.Webhook.Listen != "" {
 			go func() {
-				ch, err := startListen(&config.Webhook)
+				ch, err := startListen(&config.Webhook, webhookHandlers)
 				if err != nil {
 					log.Print(err)
 					return
@@ -94,123 +228,304 @@ func startNetboxSync(config *Config, zms *map[string]*zoneManager) error {
 				go syncNetbox(config, zms, ds)
 			}
 		}()
+		go func() {
+			for range syncRequest {
+				go syncNetbox(config, zms, ds)
+			}
+		}()
 		select {}
 	}()
 	return nil
 }
 
 func syncNetbox(config *Config, zms *map[string]*zoneManager, ds dataStore) {
+	start := time.Now()
 	newTree := map[string]*dnsTree{}
 	for _, zm := range *zms {
-		_, ok := newTree[zm.ZoneConfig.Suffix]
+		_, ok := newTree[zm.name()]
 		if !ok {
-			newTree[zm.ZoneConfig.Suffix] = newDNSTree()
+			newTree[zm.name()] = newDNSTree()
 		}
 		for name, record := range zm.ZoneConfig.Records {
 			for _, r := range record {
-				newTree[zm.ZoneConfig.Suffix].addRecords(name, r)
+				newTree[zm.name()].addRecords(name, r)
 			}
 		}
 	}
-	for i := 0; ; i++ {
-		client := getClient(config)
-		resp, err := client.R().SetQueryParams(map[string]string{
-			"limit":  fmt.Sprint(limit),
-			"offset": fmt.Sprint(limit * i),
-		}).Get("/api/ipam/ip-addresses")
+	client := getClient(config)
+	ipAddresses := []ipAddress{}
+	if err := fetchAll(client, "/api/ipam/ip-addresses", nil, func(body []byte) (*string, error) {
+		ipAddressResp := ipAddressResp{}
+		if err := json.Unmarshal(body, &ipAddressResp); err != nil {
+			return nil, err
+		}
+		ipAddresses = append(ipAddresses, ipAddressResp.Results...)
+		return ipAddressResp.Next, nil
+	}); err != nil {
+		log.Print(err)
+		netboxSyncFailures.add(1)
+		return
+	}
+	for _, result := range ipAddresses {
+		var domain string
+		switch config.Netbox.Mode {
+		case "description":
+			domain = dns.Fqdn(result.Description)
+		case "dns":
+			domain = dns.Fqdn(result.DNS)
+		default:
+			log.Print(fmt.Errorf("invalid mode"))
+		}
+		ip := net.ParseIP(strings.Split(result.Address, "/")[0])
+		if ip == nil {
+			continue
+		}
+		reverse, err := dns.ReverseAddr(ip.String())
 		if err != nil {
-			log.Println(err)
+			continue
 		}
-		ipAddressResp := ipAddressResp{}
-		if err := json.Unmarshal(resp.Body(), &ipAddressResp); err != nil {
+		for _, zm := range *zms {
+			if !zm.ZoneConfig.View.matchAddress(&result, ip) {
+				continue
+			}
+			if zm.includesBySuffix(reverse) && isHostname(domain) {
+				_, ok := newTree[zm.name()]
+				if !ok {
+					continue
+				}
+				prefix, err := zm.getPrefixBySuffix(reverse)
+				if err != nil {
+					continue
+				}
+				newTree[zm.name()].addRecords(prefix, dnsRecord{
+					DNSType: dns.TypePTR,
+					PTR:     domain,
+				})
+				continue
+			}
+			if zm.includesBySuffix(domain) {
+				_, ok := newTree[zm.name()]
+				if !ok {
+					continue
+				}
+				prefix, err := zm.getPrefixBySuffix(domain)
+				if err != nil {
+					continue
+				}
+				if ip.To4() != nil {
+					newTree[zm.name()].addRecords(prefix, dnsRecord{
+						DNSType: dns.TypeA,
+						A:       ip,
+					})
+				} else {
+					newTree[zm.name()].addRecords(prefix, dnsRecord{
+						DNSType: dns.TypeAAAA,
+						AAAA:    ip,
+					})
+				}
+			}
+		}
+	}
+	if config.Netbox.Services != nil {
+		services := []service{}
+		if err := fetchAll(client, "/api/ipam/services", nil, func(body []byte) (*string, error) {
+			serviceResp := serviceResp{}
+			if err := json.Unmarshal(body, &serviceResp); err != nil {
+				return nil, err
+			}
+			services = append(services, serviceResp.Results...)
+			return serviceResp.Next, nil
+		}); err != nil {
+			// the addresses are committed with the SRV records of the last
+			// sync.
 			log.Print(err)
-			break
+			netboxSyncFailures.add(1)
+			keepRecords(zms, newTree, dns.TypeSRV)
+			services = nil
 		}
-		if resp.StatusCode() != 200 {
-			log.Print(string(resp.Body()))
-			log.Print(fmt.Errorf("invalid status code: %d", resp.StatusCode()))
-			break
-		}
-		for _, result := range ipAddressResp.Results {
-			var domain string
-			switch config.Netbox.Mode {
-			case "description":
-				domain = dns.Fqdn(result.Description)
-			case "dns":
-				domain = dns.Fqdn(result.DNS)
-			default:
-				log.Print(fmt.Errorf("invalid mode"))
+		for _, result := range services {
+			var target string
+			if result.Device != nil {
+				target = dns.Fqdn(result.Device.Name)
+			} else if result.VirtualMachine != nil {
+				target = dns.Fqdn(result.VirtualMachine.Name)
+			} else {
+				continue
+			}
+			name := fmt.Sprintf("_%s._%s", serviceLabel(result.Name), strings.ToLower(result.Protocol.Label))
+			ports := result.Ports
+			if result.Port != nil {
+				ports = append(ports, *result.Port)
 			}
 			for _, zm := range *zms {
-				if zm.includesBySuffix(domain) {
-					_, ok := newTree[zm.ZoneConfig.Suffix]
-					if !ok {
-						continue
-					}
-					prefix, err := zm.getPrefixBySuffix(domain)
-					if err != nil {
-						continue
-					}
-					ip := net.ParseIP(strings.Split(result.Address, "/")[0])
-					if ip.To4() != nil {
-						newTree[zm.ZoneConfig.Suffix].addRecords(prefix, dnsRecord{
-							DNSType: dns.TypeA,
-							A:       ip,
-						})
-					} else {
-						newTree[zm.ZoneConfig.Suffix].addRecords(prefix, dnsRecord{
-							DNSType: dns.TypeAAAA,
-							AAAA:    ip,
-						})
-					}
+				if !zm.includesBySuffix(target) {
+					continue
 				}
-			}
-		}
-		if ipAddressResp.Next == nil {
-			log.Println("sync complete.")
-			sortAllZone(&newTree)
-			for zoneName, tree := range newTree {
-				zm, ok := (*zms)[zoneName]
+				_, ok := newTree[zm.name()]
 				if !ok {
-					zm.Tree = *tree
-					if ds != nil {
-						if err := ds.setZone(zoneName, &zoneStoreData{
-							Serial: zm.getSerial(),
-							Tree:   tree,
-						}); err != nil {
-							log.Println(err)
-						}
-					}
-					log.Printf("update zone: %s\n", zoneName)
 					continue
 				}
-				if !compareZone(tree, &zm.Tree) {
-					diff := ""
-					if &zm.Tree != nil {
-						diff = cmp.Diff(zm.Tree.Records, tree.Records)
-						fmt.Print(diff)
-					}
-					zm.updateSerial()
-					zm.Tree = *tree
-					if ds != nil {
-						if err := ds.setZone(zoneName, &zoneStoreData{
-							Serial: zm.getSerial(),
-							Tree:   tree,
-						}); err != nil {
-							log.Println(err)
-						}
-					}
-					err := notifySlack(&config.Slack, zoneName, zm.getSerial(), diff)
-					if err != nil {
-						fmt.Println(err)
-					}
-					log.Printf("update zone: %s serial: %d\n", zoneName, zm.getSerial())
+				for _, port := range ports {
+					newTree[zm.name()].addRecords(name, dnsRecord{
+						DNSType: dns.TypeSRV,
+						SRV: srvRecord{
+							Priority: config.Netbox.Services.Priority,
+							Weight:   config.Netbox.Services.Weight,
+							Port:     port,
+							Target:   target,
+						},
+					})
+				}
+			}
+		}
+	}
+	log.Println("sync complete.")
+	sortAllZone(&newTree)
+	for zoneName, tree := range newTree {
+		zm, ok := (*zms)[zoneName]
+		if !ok {
+			continue
+		}
+		zm.mu.Lock()
+		zm.Base = *tree
+		merged := mergeTree(tree, &zm.Dynamic)
+		if !compareZone(merged, &zm.Tree) {
+			zm.commitTree(config, merged)
+		}
+		zm.mu.Unlock()
+	}
+	netboxSyncDuration.observe(time.Since(start).Seconds())
+	netboxLastSync.set(float64(time.Now().Unix()))
+}
+
+// keepRecords copies the records of type t in the base layer of the zones to
+// newTree, for records which could not be fetched from netbox.
+func keepRecords(zms *map[string]*zoneManager, newTree map[string]*dnsTree, t uint16) {
+	for zoneName, tree := range newTree {
+		zm, ok := (*zms)[zoneName]
+		if !ok {
+			continue
+		}
+		zm.mu.RLock()
+		for name, records := range zm.Base.Records {
+			for _, r := range records {
+				if r.DNSType == t && !tree.hasRecord(name, r) {
+					tree.addRecords(name, r)
 				}
 			}
-			break
 		}
-		log.Println(*ipAddressResp.Next)
+		zm.mu.RUnlock()
+	}
+}
+
+// commitTree replaces the records of the zone with tree, bumps the serial
+// and propagates the change. The caller must hold zm.mu.
+func (zm *zoneManager) commitTree(config *Config, tree *dnsTree) {
+	diff := cmp.Diff(zm.Tree.Records, tree.Records)
+	fmt.Print(diff)
+	from := zm.getSerial()
+	zm.updateSerial()
+	zm.addJournal(from, &zm.Tree, tree, config.DataStore.JournalSize)
+	tree.index()
+	zm.Tree = *tree
+	if zm.DataStore != nil {
+		if err := zm.DataStore.setZone(zm.name(), &zoneStoreData{
+			Serial:  zm.getSerial(),
+			Tree:    tree,
+			Base:    &zm.Base,
+			Dynamic: &zm.Dynamic,
+			Journal: zm.Journal,
+		}); err != nil {
+			log.Println(err)
+		}
+	}
+	zm.sendNotify(config.TsigSecrets)
+	go func(serial uint32) {
+		err := notifySlack(&config.Slack, zm.name(), serial, diff)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}(zm.getSerial())
+	log.Printf("update zone: %s serial: %d\n", zm.name(), zm.getSerial())
+}
+
+// baseTree returns the base layer of the stored zone zd. Stores written
+// before the base layer was kept get it from the tree without the dynamic
+// records.
+func baseTree(zd *zoneStoreData) *dnsTree {
+	if zd.Base != nil {
+		return zd.Base
+	}
+	base := newDNSTree()
+	for name, records := range zd.Tree.Records {
+		for _, r := range records {
+			if zd.Dynamic == nil || !zd.Dynamic.hasRecord(name, r) {
+				base.addRecords(name, r)
+			}
+		}
+	}
+	return base
+}
+
+// mergeTree returns a copy of base with the records of dynamic added.
+func mergeTree(base *dnsTree, dynamic *dnsTree) *dnsTree {
+	tree := newDNSTree()
+	for name, records := range base.Records {
+		for _, r := range records {
+			tree.addRecords(name, r)
+		}
+	}
+	for name, records := range dynamic.Records {
+		for _, r := range records {
+			if !tree.hasRecord(name, r) {
+				tree.addRecords(name, r)
+			}
+		}
 	}
+	sortTree(tree)
+	return tree
+}
+
+// fetchAll walks through every page of a netbox list endpoint, filtered by
+// params, and passes the body of each page to handle, which returns the url
+// of the next page.
+func fetchAll(client *resty.Client, path string, params map[string]string, handle func(body []byte) (*string, error)) error {
+	for i := 0; ; i++ {
+		resp, err := client.R().SetQueryParams(params).SetQueryParams(map[string]string{
+			"limit":  fmt.Sprint(limit),
+			"offset": fmt.Sprint(limit * i),
+		}).Get(path)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode() != 200 {
+			log.Print(string(resp.Body()))
+			return fmt.Errorf("invalid status code: %d", resp.StatusCode())
+		}
+		netboxPagesFetched.add(1, path)
+		next, err := handle(resp.Body())
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		log.Println(*next)
+	}
+}
+
+// serviceLabel converts the name of a netbox service to a label usable in
+// an SRV owner name, e.g. "LDAP Global Catalog" to "ldap-global-catalog".
+func serviceLabel(name string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-':
+			return c
+		case c >= 'A' && c <= 'Z':
+			return c - 'A' + 'a'
+		}
+		return '-'
+	}, strings.TrimSpace(name))
 }
 
 func compareZone(zone1 *dnsTree, zone2 *dnsTree) bool {
@@ -229,54 +544,88 @@ func compareZone(zone1 *dnsTree, zone2 *dnsTree) bool {
 			return false
 		}
 		for i, record1 := range records1 {
-			if record1.DNSType != records2[i].DNSType {
+			if !recordEqual(record1, records2[i]) {
 				return false
 			}
-			if record1.DNSType == dns.TypeA {
-				if bytes.Compare(record1.A, records2[i].A) != 0 {
-					return false
-				}
-			}
-			if record1.DNSType == dns.TypeAAAA {
-				if bytes.Compare(record1.AAAA, records2[i].AAAA) != 0 {
-					return false
-				}
-			}
-			if record1.DNSType == dns.TypeCNAME {
-				if record1.CNAME != records2[i].CNAME {
-					return false
-				}
-			}
-			if record1.DNSType == dns.TypeTXT {
-				if record1.TXT != records2[i].TXT {
-					return false
-				}
-			}
 		}
 	}
 	return true
 }
 
+func recordEqual(record1 dnsRecord, record2 dnsRecord) bool {
+	if record1.DNSType != record2.DNSType {
+		return false
+	}
+	switch record1.DNSType {
+	case dns.TypeA:
+		return bytes.Compare(record1.A, record2.A) == 0
+	case dns.TypeAAAA:
+		return bytes.Compare(record1.AAAA, record2.AAAA) == 0
+	case dns.TypeCNAME:
+		return record1.CNAME == record2.CNAME
+	case dns.TypeTXT:
+		return record1.TXT == record2.TXT
+	case dns.TypePTR:
+		return record1.PTR == record2.PTR
+	case dns.TypeNS:
+		return record1.NS == record2.NS
+	case dns.TypeMX:
+		return record1.MX == record2.MX
+	case dns.TypeSRV:
+		return record1.SRV == record2.SRV
+	case typeALIAS:
+		return record1.ALIAS == record2.ALIAS
+	}
+	return true
+}
+
 func sortAllZone(zones *map[string]*dnsTree) {
 	for _, zone := range *zones {
-		for _, records := range zone.Records {
-			sort.Slice(records, func(i, j int) bool {
-				if records[i].DNSType == records[j].DNSType {
-					switch records[i].DNSType {
-					case dns.TypeA:
-						return bytes.Compare(records[i].A, records[j].A) < 0
-					case dns.TypeAAAA:
-						return bytes.Compare(records[i].AAAA, records[j].AAAA) < 0
-					case dns.TypeTXT:
-						return records[i].TXT < records[j].TXT
-					case dns.TypeCNAME:
-						// invalid
-						return true
+		sortTree(zone)
+	}
+}
+
+func sortTree(zone *dnsTree) {
+	for _, records := range zone.Records {
+		sort.Slice(records, func(i, j int) bool {
+			if records[i].DNSType == records[j].DNSType {
+				switch records[i].DNSType {
+				case dns.TypeA:
+					return bytes.Compare(records[i].A, records[j].A) < 0
+				case dns.TypeAAAA:
+					return bytes.Compare(records[i].AAAA, records[j].AAAA) < 0
+				case dns.TypeTXT:
+					return records[i].TXT < records[j].TXT
+				case dns.TypePTR:
+					return records[i].PTR < records[j].PTR
+				case dns.TypeNS:
+					return records[i].NS < records[j].NS
+				case dns.TypeMX:
+					if records[i].MX.Preference == records[j].MX.Preference {
+						return records[i].MX.Exchange < records[j].MX.Exchange
+					}
+					return records[i].MX.Preference < records[j].MX.Preference
+				case dns.TypeSRV:
+					a, b := records[i].SRV, records[j].SRV
+					if a.Priority != b.Priority {
+						return a.Priority < b.Priority
 					}
+					if a.Weight != b.Weight {
+						return a.Weight < b.Weight
+					}
+					if a.Target != b.Target {
+						return a.Target < b.Target
+					}
+					return a.Port < b.Port
+				case dns.TypeCNAME:
+					// invalid
+					return true
+				case typeALIAS:
+					return records[i].ALIAS < records[j].ALIAS
 				}
-				return records[i].DNSType < records[j].DNSType
-			})
-		}
+			}
+			return records[i].DNSType < records[j].DNSType
+		})
 	}
 }
 
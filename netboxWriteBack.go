@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// syncRequest triggers a netbox sync, e.g. after a write back.
+var syncRequest = make(chan struct{}, 1)
+
+func requestSync() {
+	select {
+	case syncRequest <- struct{}{}:
+	default:
+	}
+}
+
+// isWriteBack reports whether rr of an update section is written back to
+// netbox instead of the dynamic layer.
+func isWriteBack(config *Config, rr dns.RR) bool {
+	if !config.Netbox.WriteBack {
+		return false
+	}
+	switch rr.Header().Rrtype {
+	case dns.TypeA, dns.TypeAAAA:
+		return true
+	case dns.TypeANY:
+		return rr.Header().Class == dns.ClassANY
+	}
+	return false
+}
+
+// netboxChange is a write to an ip address object, kept to roll back an
+// update which fails halfway.
+type netboxChange struct {
+	id      int
+	address string
+	field   string
+	// old is the previous name, unless the object has been created.
+	old     string
+	created bool
+}
+
+// writeBack applies the A and AAAA records of an update section to the ip
+// addresses of netbox and reports whether netbox has been written. The
+// writes done so far are rolled back on failure.
+func writeBack(config *Config, updates []dns.RR) (bool, error) {
+	changes := []netboxChange{}
+	for _, rr := range updates {
+		if !isWriteBack(config, rr) {
+			continue
+		}
+		hdr := rr.Header()
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		var err error
+		var done []netboxChange
+		switch hdr.Class {
+		case dns.ClassINET:
+			done, err = netboxAddAddress(config, hdr.Name, ip)
+		case dns.ClassNONE:
+			done, err = netboxRemoveAddress(config, hdr.Name, hdr.Rrtype, ip)
+		case dns.ClassANY:
+			done, err = netboxRemoveAddress(config, hdr.Name, hdr.Rrtype, nil)
+		}
+		changes = append(changes, done...)
+		if err != nil {
+			if !netboxRollback(config, changes) {
+				// the zone follows netbox with the next sync.
+				requestSync()
+			}
+			return false, err
+		}
+	}
+	return len(changes) != 0, nil
+}
+
+// netboxRollback undoes changes in reverse order and reports whether all of
+// them have been undone.
+func netboxRollback(config *Config, changes []netboxChange) bool {
+	ok := true
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		var err error
+		if c.created {
+			err = netboxDeleteAddress(config, c.id)
+		} else {
+			err = netboxSetName(config, c.id, c.field, c.old)
+		}
+		if err != nil {
+			log.Printf("write back: rollback of %s failed: %s\n", c.address, err)
+			ok = false
+			continue
+		}
+		log.Printf("write back: rolled back %s\n", c.address)
+	}
+	return ok
+}
+
+func netboxNameField(config *Config) (string, error) {
+	switch config.Netbox.Mode {
+	case "description":
+		return "description", nil
+	case "dns":
+		return "dns_name", nil
+	}
+	return "", fmt.Errorf("invalid mode")
+}
+
+func (ip *ipAddress) name(field string) string {
+	if field == "dns_name" {
+		return ip.DNS
+	}
+	return ip.Description
+}
+
+// netboxGetAddresses returns the ip address objects matching params, on every
+// page.
+func netboxGetAddresses(config *Config, params map[string]string) ([]ipAddress, error) {
+	addresses := []ipAddress{}
+	err := fetchAll(getClient(config), "/api/ipam/ip-addresses/", params, func(body []byte) (*string, error) {
+		ipAddressResp := ipAddressResp{}
+		if err := json.Unmarshal(body, &ipAddressResp); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, ipAddressResp.Results...)
+		return ipAddressResp.Next, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// ip returns the address of the object without the prefix length.
+func (ip *ipAddress) ip() net.IP {
+	return net.ParseIP(strings.Split(ip.Address, "/")[0])
+}
+
+func netboxSetName(config *Config, id int, field string, name string) error {
+	resp, err := getClient(config).R().
+		SetBody(map[string]string{field: name}).
+		Patch(fmt.Sprintf("/api/ipam/ip-addresses/%d/", id))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("invalid status code: %d", resp.StatusCode())
+	}
+	return nil
+}
+
+func netboxDeleteAddress(config *Config, id int) error {
+	resp, err := getClient(config).R().Delete(fmt.Sprintf("/api/ipam/ip-addresses/%d/", id))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != 204 {
+		return fmt.Errorf("invalid status code: %d", resp.StatusCode())
+	}
+	return nil
+}
+
+// netboxAddAddress points the ip address object of ip to name, creating it
+// when it does not exist.
+func netboxAddAddress(config *Config, name string, ip net.IP) ([]netboxChange, error) {
+	field, err := netboxNameField(config)
+	if err != nil {
+		return nil, err
+	}
+	value := strings.TrimSuffix(name, ".")
+	results, err := netboxGetAddresses(config, map[string]string{"address": ip.String()})
+	if err != nil {
+		return nil, err
+	}
+	// netbox may ignore an unknown filter, so the results are checked.
+	addresses := []ipAddress{}
+	for _, address := range results {
+		if address.ip().Equal(ip) {
+			addresses = append(addresses, address)
+		}
+	}
+	for _, address := range addresses {
+		if strings.EqualFold(dns.Fqdn(address.name(field)), name) {
+			return nil, nil
+		}
+	}
+	if len(addresses) != 0 {
+		log.Printf("write back: %s %s\n", addresses[0].Address, value)
+		change := netboxChange{id: addresses[0].ID, address: addresses[0].Address, field: field, old: addresses[0].name(field)}
+		if err := netboxSetName(config, change.id, field, value); err != nil {
+			return nil, err
+		}
+		return []netboxChange{change}, nil
+	}
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+	address := fmt.Sprintf("%s/%d", ip, bits)
+	resp, err := getClient(config).R().
+		SetBody(map[string]string{"address": address, "status": "active", field: value}).
+		Post("/api/ipam/ip-addresses/")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != 201 {
+		return nil, fmt.Errorf("invalid status code: %d", resp.StatusCode())
+	}
+	created := ipAddress{}
+	if err := json.Unmarshal(resp.Body(), &created); err != nil {
+		return nil, err
+	}
+	log.Printf("write back: %s %s\n", address, value)
+	return []netboxChange{{id: created.ID, address: address, field: field, created: true}}, nil
+}
+
+// netboxRemoveAddress clears name from the ip address objects of type t
+// (A, AAAA or ANY), restricted to ip unless it is nil.
+func netboxRemoveAddress(config *Config, name string, t uint16, ip net.IP) ([]netboxChange, error) {
+	field, err := netboxNameField(config)
+	if err != nil {
+		return nil, err
+	}
+	value := strings.TrimSuffix(name, ".")
+	params := map[string]string{field: value}
+	if ip != nil {
+		params = map[string]string{"address": ip.String()}
+	}
+	addresses, err := netboxGetAddresses(config, params)
+	if err != nil {
+		return nil, err
+	}
+	changes := []netboxChange{}
+	for _, address := range addresses {
+		// netbox may ignore an unknown filter, so the results are checked.
+		if !strings.EqualFold(dns.Fqdn(address.name(field)), name) {
+			continue
+		}
+		addr := address.ip()
+		if addr == nil || ip != nil && !addr.Equal(ip) {
+			continue
+		}
+		if t == dns.TypeA && addr.To4() == nil || t == dns.TypeAAAA && addr.To4() != nil {
+			continue
+		}
+		log.Printf("write back: %s removed from %s\n", value, address.Address)
+		if err := netboxSetName(config, address.ID, field, ""); err != nil {
+			return changes, err
+		}
+		changes = append(changes, netboxChange{id: address.ID, address: address.Address, field: field, old: address.name(field)})
+	}
+	return changes, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	notifyRetry   = 5
+	notifyTimeout = 2 * time.Second
+	notifyBackoff = 5 * time.Second
+)
+
+// getNotifyTargets returns the addresses of the secondaries to be notified.
+func (zm *zoneManager) getNotifyTargets() []string {
+	targets := append([]string{}, zm.ZoneConfig.Notify.Targets...)
+	if zm.ZoneConfig.Notify.AllowTransfer {
+		for _, subnet := range zm.ZoneConfig.AllowTransfer {
+			// only single hosts can be notified, not whole networks.
+			if ones, bits := subnet.Mask.Size(); ones != bits {
+				continue
+			}
+			targets = append(targets, net.JoinHostPort(subnet.IP.String(), "53"))
+		}
+	}
+	if zm.ZoneConfig.View == nil {
+		return targets
+	}
+	// secondaries are notified of the view they transfer.
+	result := []string{}
+	for _, target := range targets {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			continue
+		}
+		if v, ok := selectView(net.ParseIP(host)); ok && v == zm.ZoneConfig.View {
+			result = append(result, target)
+		}
+	}
+	return result
+}
+
+// sendNotify tells the secondaries that the zone has changed (RFC 1996).
+func (zm *zoneManager) sendNotify(tsigSecrets []tsigSecretConfig) {
+	soa, err := zm.getSOA(zm.ZoneConfig.Origin)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	keys, err := newTsigKeys(tsigSecrets)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	key := zm.ZoneConfig.Notify.TsigKey
+	algorithm, ok := keys.algorithm(key)
+	if key != "" && !ok {
+		log.Printf("notify: tsig key %s not found\n", key)
+		return
+	}
+	for _, target := range zm.getNotifyTargets() {
+		go func(target string) {
+			client := &dns.Client{Net: "udp", Timeout: notifyTimeout, TsigProvider: keys}
+			backoff := notifyBackoff
+			for i := 0; i < notifyRetry; i++ {
+				m := new(dns.Msg)
+				m.SetNotify(zm.ZoneConfig.Origin)
+				m.Answer = []dns.RR{soa}
+				if key != "" {
+					m.SetTsig(key, algorithm, 300, time.Now().Unix())
+				}
+				r, _, err := client.Exchange(m, target)
+				if err == nil && r.Rcode == dns.RcodeSuccess {
+					log.Printf("notify: %s serial %d acknowledged by %s\n", zm.name(), soa.Serial, target)
+					return
+				}
+				if err == nil {
+					log.Printf("notify: %s rejected by %s: %s\n", zm.name(), target, dns.RcodeToString[r.Rcode])
+					return
+				}
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+			log.Printf("notify: %s serial %d unanswered by %s\n", zm.name(), soa.Serial, target)
+		}(target)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryLog is the dns.Handler logging every query and its response, as text
+// or json lines and/or as dnstap messages, and accounting it to the metrics.
+// Entries are written in the background and dropped when the writers fall
+// behind.
+type queryLog struct {
+	handler dns.Handler
+	metrics bool
+	json    bool
+	out     *log.Logger
+	dnstap  *dnstapWriter
+	entries chan *queryLogEntry
+	stop    chan chan struct{}
+}
+
+type queryLogEntry struct {
+	start     time.Time
+	end       time.Time
+	local     net.Addr
+	remote    net.Addr
+	transport string
+	view      *view
+	zone      string
+	query     *dns.Msg
+	// response is nil when no response was sent, e.g. by rate limiting.
+	response *dns.Msg
+}
+
+// newQueryLog returns the queryLog of handler, which only accounts the
+// metrics when qc is nil.
+func newQueryLog(qc *queryLogConfig, handler dns.Handler, metrics bool) (*queryLog, error) {
+	ql := &queryLog{
+		handler: handler,
+		metrics: metrics,
+		entries: make(chan *queryLogEntry, 1024),
+		stop:    make(chan chan struct{}),
+	}
+	if qc == nil {
+		qc = &queryLogConfig{}
+	}
+	switch qc.Format {
+	case "":
+	case "text", "json":
+		var out io.Writer = log.Writer()
+		if qc.File != "" {
+			f, err := os.OpenFile(qc.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, err
+			}
+			out = f
+		}
+		ql.json = qc.Format == "json"
+		if ql.json {
+			ql.out = log.New(out, "", 0)
+		} else {
+			ql.out = log.New(out, "", log.LstdFlags)
+		}
+	default:
+		return nil, fmt.Errorf("invalid query log format: %s", qc.Format)
+	}
+	if qc.Dnstap != nil {
+		dw, err := newDnstapWriter(qc.Dnstap)
+		if err != nil {
+			return nil, err
+		}
+		ql.dnstap = dw
+	}
+	if ql.out != nil || ql.dnstap != nil {
+		go ql.run()
+	}
+	return ql, nil
+}
+
+func (ql *queryLog) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	qw := &queryLogWriter{ResponseWriter: w}
+	start := time.Now()
+	ql.handler.ServeDNS(qw, r)
+	e := &queryLogEntry{
+		start:     start,
+		end:       qw.written,
+		local:     w.LocalAddr(),
+		remote:    w.RemoteAddr(),
+		transport: transport(w),
+		view:      qw.view,
+		zone:      qw.zone,
+		query:     r,
+		response:  qw.msg,
+	}
+	if ql.metrics {
+		observeQuery(e)
+	}
+	if ql.out == nil && ql.dnstap == nil {
+		return
+	}
+	select {
+	case ql.entries <- e:
+	default:
+	}
+}
+
+func (ql *queryLog) run() {
+	for {
+		select {
+		case e := <-ql.entries:
+			if ql.out != nil {
+				ql.print(e)
+			}
+			if ql.dnstap != nil {
+				ql.dnstap.write(e)
+				if len(ql.entries) == 0 {
+					ql.dnstap.flush()
+				}
+			}
+		case done := <-ql.stop:
+			if ql.dnstap != nil {
+				ql.dnstap.close()
+			}
+			close(done)
+			return
+		}
+	}
+}
+
+// close stops logging and ends the dnstap stream, on shutdown.
+func (ql *queryLog) close() {
+	if ql.out == nil && ql.dnstap == nil {
+		return
+	}
+	done := make(chan struct{})
+	ql.stop <- done
+	<-done
+}
+
+type queryLogRecord struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Transport string    `json:"transport"`
+	View      string    `json:"view,omitempty"`
+	Zone      string    `json:"zone,omitempty"`
+	QName     string    `json:"qname"`
+	QType     string    `json:"qtype"`
+	Rcode     string    `json:"rcode,omitempty"`
+	// Latency is in milliseconds.
+	Latency float64 `json:"latency,omitempty"`
+}
+
+func (ql *queryLog) print(e *queryLogEntry) {
+	rec := queryLogRecord{
+		Time:      e.start,
+		Client:    e.remote.String(),
+		Transport: e.transport,
+		Zone:      e.zone,
+	}
+	if e.view != nil {
+		rec.View = e.view.Name
+	}
+	if len(e.query.Question) != 0 {
+		rec.QName = e.query.Question[0].Name
+		rec.QType = dns.Type(e.query.Question[0].Qtype).String()
+	}
+	if e.response != nil {
+		rec.Rcode = dns.RcodeToString[e.response.Rcode]
+		rec.Latency = float64(e.end.Sub(e.start)) / float64(time.Millisecond)
+	}
+	if ql.json {
+		buf, err := json.Marshal(rec)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		ql.out.Println(string(buf))
+		return
+	}
+	rcode, latency := "-", "-"
+	if e.response != nil {
+		rcode, latency = rec.Rcode, e.end.Sub(e.start).String()
+	}
+	view := "-"
+	if rec.View != "" {
+		view = rec.View
+	}
+	ql.out.Printf("query: client=%s transport=%s view=%s qname=%s qtype=%s rcode=%s latency=%s\n",
+		rec.Client, rec.Transport, view, rec.QName, rec.QType, rcode, latency)
+}
+
+// transport returns udp, tcp, tls or doh.
+func transport(w dns.ResponseWriter) string {
+	if _, ok := w.(*dohResponseWriter); ok {
+		return "doh"
+	}
+	if connectionState(w) != nil {
+		return "tls"
+	}
+	return w.LocalAddr().Network()
+}
+
+// queryLogWriter keeps the first response written, along with the view and
+// zone the query was answered from.
+type queryLogWriter struct {
+	dns.ResponseWriter
+	msg     *dns.Msg
+	written time.Time
+	view    *view
+	zone    string
+}
+
+func (qw *queryLogWriter) WriteMsg(m *dns.Msg) error {
+	if qw.msg == nil {
+		qw.msg = m
+		qw.written = time.Now()
+	}
+	return qw.ResponseWriter.WriteMsg(m)
+}
+
+func (qw *queryLogWriter) ConnectionState() *tls.ConnectionState {
+	return connectionState(qw.ResponseWriter)
+}
+
+// setQueryView records the view and zone of the query for the query log.
+func setQueryView(w dns.ResponseWriter, v *view, zone string) {
+	if qw, ok := w.(*queryLogWriter); ok {
+		qw.view = v
+		qw.zone = zone
+	}
+}
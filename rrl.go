@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	rrlPass = iota
+	rrlDrop
+	rrlSlip
+)
+
+// rateLimiter is the response rate limiting of UDP answers in the manner of
+// BIND. Responses with the same name, type and rcode to the same client
+// network are limited to the configured rate, averaged over the window.
+// Every slip-th limited response is sent truncated, so that legitimate
+// clients retry over tcp, and the others are dropped.
+type rateLimiter struct {
+	rate   float64
+	window time.Duration
+	slip   int
+	v4Mask net.IPMask
+	v6Mask net.IPMask
+	exempt []*net.IPNet
+
+	mu        sync.Mutex
+	buckets   map[rrlKey]*rrlBucket
+	lastClean time.Time
+}
+
+type rrlKey struct {
+	prefix string
+	name   string
+	qtype  uint16
+	rcode  int
+}
+
+type rrlBucket struct {
+	balance float64
+	last    time.Time
+	limited int
+}
+
+// limiter is nil unless rate limiting is configured.
+var limiter *rateLimiter
+
+func newRateLimiter(rc *rateLimitConfig) (*rateLimiter, error) {
+	rl := &rateLimiter{
+		rate:    float64(rc.ResponsesPerSecond),
+		window:  15 * time.Second,
+		slip:    2,
+		v4Mask:  net.CIDRMask(24, 32),
+		v6Mask:  net.CIDRMask(56, 128),
+		exempt:  []*net.IPNet{},
+		buckets: map[rrlKey]*rrlBucket{},
+	}
+	if rc.Window != nil {
+		rl.window = time.Duration(*rc.Window) * time.Second
+	}
+	if rc.Slip != nil {
+		rl.slip = *rc.Slip
+	}
+	if rc.IPv4PrefixLength != nil {
+		rl.v4Mask = net.CIDRMask(*rc.IPv4PrefixLength, 32)
+	}
+	if rc.IPv6PrefixLength != nil {
+		rl.v6Mask = net.CIDRMask(*rc.IPv6PrefixLength, 128)
+	}
+	for _, exemptStr := range rc.Exempt {
+		_, subnet, err := net.ParseCIDR(exemptStr)
+		if err != nil {
+			return nil, err
+		}
+		rl.exempt = append(rl.exempt, subnet)
+	}
+	return rl, nil
+}
+
+// check accounts the response m to the client at addr and tells whether it
+// is sent (rrlPass), dropped (rrlDrop) or sent truncated (rrlSlip).
+func (rl *rateLimiter) check(addr net.Addr, m *dns.Msg) int {
+	if rl == nil || len(m.Question) == 0 {
+		return rrlPass
+	}
+	ip, err := parseIP(addr.String())
+	if err != nil {
+		return rrlPass
+	}
+	for _, exempt := range rl.exempt {
+		if exempt.Contains(ip) {
+			return rrlPass
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4.Mask(rl.v4Mask)
+	} else {
+		ip = ip.Mask(rl.v6Mask)
+	}
+	key := rrlKey{
+		prefix: ip.String(),
+		name:   strings.ToLower(rrlName(m)),
+		qtype:  m.Question[0].Qtype,
+		rcode:  m.Rcode,
+	}
+
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastClean) > rl.window {
+		for k, b := range rl.buckets {
+			if now.Sub(b.last) > rl.window {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastClean = now
+	}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &rrlBucket{balance: rl.rate, last: now}
+		rl.buckets[key] = b
+	}
+	b.balance += now.Sub(b.last).Seconds() * rl.rate
+	if b.balance > rl.rate {
+		b.balance = rl.rate
+	}
+	b.last = now
+	b.balance--
+	if min := -rl.window.Seconds() * rl.rate; b.balance < min {
+		b.balance = min
+	}
+	if b.balance >= 0 {
+		return rrlPass
+	}
+	b.limited++
+	if rl.slip != 0 && b.limited%rl.slip == 0 {
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+// rrlName returns the name responses are accounted to. NXDOMAIN answers and
+// referrals are accounted to the zone and the delegation respectively, and
+// other errors such as REFUSED to no name, so that random names do not
+// escape the limit.
+func rrlName(m *dns.Msg) string {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return ""
+	}
+	if m.Rcode == dns.RcodeNameError || len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			switch rr.Header().Rrtype {
+			case dns.TypeSOA, dns.TypeNS:
+				return rr.Header().Name
+			}
+		}
+	}
+	return m.Question[0].Name
+}
+
+// rateLimit accounts the response m to a UDP client and tells whether it is
+// to be sent. A limited response is dropped or sent truncated instead.
+func rateLimit(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) bool {
+	if w.LocalAddr().Network() != "udp" {
+		return true
+	}
+	switch limiter.check(w.RemoteAddr(), m) {
+	case rrlDrop:
+		return false
+	case rrlSlip:
+		w.WriteMsg(slipMsg(r, m))
+		return false
+	}
+	return true
+}
+
+// writeLimited writes an error response, subject to the rate limit.
+func writeLimited(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if rateLimit(w, r, m) {
+		w.WriteMsg(m)
+	}
+}
+
+// slipMsg returns the empty truncated response sent instead of m.
+func slipMsg(r *dns.Msg, m *dns.Msg) *dns.Msg {
+	tc := new(dns.Msg)
+	tc.SetRcode(r, m.Rcode)
+	tc.Authoritative = m.Authoritative
+	tc.Truncated = true
+	setEdns(r, tc)
+	return tc
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimiterCheck(t *testing.T) {
+	intp := func(i int) *int { return &i }
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	tests := []struct {
+		name   string
+		config rateLimitConfig
+		addr   net.Addr
+		want   []int
+	}{
+		{"slip every second", rateLimitConfig{ResponsesPerSecond: 2}, client,
+			[]int{rrlPass, rrlPass, rrlDrop, rrlSlip, rrlDrop, rrlSlip}},
+		{"slip every one", rateLimitConfig{ResponsesPerSecond: 2, Slip: intp(1)}, client,
+			[]int{rrlPass, rrlPass, rrlSlip, rrlSlip, rrlSlip}},
+		{"drop every one", rateLimitConfig{ResponsesPerSecond: 2, Slip: intp(0)}, client,
+			[]int{rrlPass, rrlPass, rrlDrop, rrlDrop, rrlDrop}},
+		{"exempt", rateLimitConfig{ResponsesPerSecond: 1, Exempt: []string{"192.0.2.0/24"}}, client,
+			[]int{rrlPass, rrlPass, rrlPass, rrlPass}},
+		{"no address", rateLimitConfig{ResponsesPerSecond: 1}, &net.UnixAddr{Name: "dns.sock", Net: "unix"},
+			[]int{rrlPass, rrlPass, rrlPass}},
+	}
+	for _, tt := range tests {
+		rl, err := newRateLimiter(&tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		m.SetQuestion("a.example.com.", dns.TypeA)
+		for i, want := range tt.want {
+			if got := rl.check(tt.addr, m); got != want {
+				t.Errorf("%s: response %d = %d, want %d", tt.name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestRateLimiterBuckets(t *testing.T) {
+	rl, err := newRateLimiter(&rateLimitConfig{ResponsesPerSecond: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := func(name string, rcode int) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Rcode = rcode
+		if rcode == dns.RcodeNameError {
+			m.Ns = []dns.RR{mustRR("example.com. 300 IN SOA ns1.example.com. root.example.com. 1 3600 900 604800 300")}
+		}
+		return m
+	}
+	addr := func(ip string) net.Addr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: 53}
+	}
+	tests := []struct {
+		name string
+		addr net.Addr
+		m    *dns.Msg
+		want int
+	}{
+		{"first", addr("192.0.2.1"), answer("a.example.com.", dns.RcodeSuccess), rrlPass},
+		{"same network", addr("192.0.2.2"), answer("A.example.com.", dns.RcodeSuccess), rrlDrop},
+		{"other name", addr("192.0.2.1"), answer("b.example.com.", dns.RcodeSuccess), rrlPass},
+		{"other network", addr("198.51.100.1"), answer("a.example.com.", dns.RcodeSuccess), rrlPass},
+		{"nxdomain", addr("192.0.2.1"), answer("x.example.com.", dns.RcodeNameError), rrlPass},
+		// NXDOMAIN is accounted to the zone, whatever the name.
+		{"other nxdomain", addr("192.0.2.1"), answer("y.example.com.", dns.RcodeNameError), rrlDrop},
+		{"refused", addr("192.0.2.1"), answer("a.example.org.", dns.RcodeRefused), rrlPass},
+		{"other refused", addr("192.0.2.1"), answer("b.example.org.", dns.RcodeRefused), rrlDrop},
+	}
+	for _, tt := range tests {
+		if got := rl.check(tt.addr, tt.m); got != tt.want {
+			t.Errorf("%s: check = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
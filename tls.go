@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// certReloader provides the certificate of a key pair, loading the files
+// again when they have been modified so that a rotated certificate is used
+// without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newTLSConfig(tc *tlsConfig) (*tls.Config, error) {
+	cr := &certReloader{certFile: tc.Cert, keyFile: tc.Key}
+	if _, err := cr.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+	}, nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	modTime, err := cr.lastModified()
+	if err != nil {
+		if cr.cert != nil {
+			log.Println(err)
+			return cr.cert, nil
+		}
+		return nil, err
+	}
+	if cr.cert != nil && modTime.Equal(cr.modTime) {
+		return cr.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		// e.g. only one of the files has been replaced yet.
+		if cr.cert != nil {
+			log.Println(err)
+			return cr.cert, nil
+		}
+		return nil, err
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	log.Printf("tls: certificate %s loaded\n", cr.certFile)
+	return cr.cert, nil
+}
+
+// lastModified returns the later modification time of the two files.
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// connectionState returns the TLS state of the connection of w, which is nil
+// for other transports.
+func connectionState(w dns.ResponseWriter) *tls.ConnectionState {
+	if cs, ok := w.(dns.ConnectionStater); ok {
+		return cs.ConnectionState()
+	}
+	return nil
+}
+
+// allowTransferTLS checks the TLS requirements of zone transfers (RFC 9103).
+// Over TLS, the client has to present one of the client certificates or sign
+// the request with the tsig key when they are configured.
+func (zm *zoneManager) allowTransferTLS(w dns.ResponseWriter, r *dns.Msg) bool {
+	tc := zm.ZoneConfig.TransferTLS
+	state := connectionState(w)
+	if state == nil {
+		return !tc.Require
+	}
+	if len(tc.ClientCertificates) == 0 && tc.TsigKey == "" {
+		return true
+	}
+	if len(state.PeerCertificates) != 0 {
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		fingerprint := hex.EncodeToString(sum[:])
+		for _, allowed := range tc.ClientCertificates {
+			if allowed == fingerprint {
+				return true
+			}
+		}
+	}
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil && tc.TsigKey != "" {
+		return strings.EqualFold(tsig.Hdr.Name, tc.TsigKey)
+	}
+	return false
+}
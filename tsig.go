@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigAlgorithms are the algorithms of tsigSecrets. Keys without one are
+// hmac-md5, which was the only algorithm before.
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+type tsigKey struct {
+	algorithm string
+	secret    []byte
+}
+
+// tsigKeys is the dns.TsigProvider of the configured keys. A key only signs
+// and verifies with its own algorithm.
+type tsigKeys map[string]tsigKey
+
+func newTsigKeys(tsigSecrets []tsigSecretConfig) (tsigKeys, error) {
+	keys := tsigKeys{}
+	for _, ts := range tsigSecrets {
+		algorithm := "hmac-md5"
+		if ts.Algorithm != nil {
+			algorithm = *ts.Algorithm
+		}
+		alg, ok := tsigAlgorithms[algorithm]
+		if !ok {
+			return nil, fmt.Errorf("tsig: unsupported algorithm %s of %s", algorithm, ts.Name)
+		}
+		secret, err := base64.StdEncoding.DecodeString(ts.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("tsig: invalid secret of %s: %s", ts.Name, err)
+		}
+		keys[dns.CanonicalName(ts.Name)] = tsigKey{algorithm: alg, secret: secret}
+	}
+	return keys, nil
+}
+
+// algorithm returns the algorithm of the key name.
+func (keys tsigKeys) algorithm(name string) (string, bool) {
+	key, ok := keys[dns.CanonicalName(name)]
+	return key.algorithm, ok
+}
+
+func (keys tsigKeys) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key, ok := keys[dns.CanonicalName(t.Hdr.Name)]
+	if !ok {
+		return nil, dns.ErrSecret
+	}
+	if dns.CanonicalName(t.Algorithm) != key.algorithm {
+		return nil, dns.ErrKeyAlg
+	}
+	var h hash.Hash
+	switch key.algorithm {
+	case dns.HmacMD5:
+		h = hmac.New(md5.New, key.secret)
+	case dns.HmacSHA1:
+		h = hmac.New(sha1.New, key.secret)
+	case dns.HmacSHA224:
+		h = hmac.New(sha256.New224, key.secret)
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, key.secret)
+	case dns.HmacSHA384:
+		h = hmac.New(sha512.New384, key.secret)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, key.secret)
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (keys tsigKeys) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := keys.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// setTsig adds the TSIG of the response m to a signed request r, which is
+// signed with the algorithm of the key when written. When the request failed
+// verification, m becomes NOTAUTH with the TSIG error (RFC 8945 5.2) and
+// setTsig returns false.
+func setTsig(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) bool {
+	tsig := r.IsTsig()
+	if tsig == nil {
+		return true
+	}
+	m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	err := w.TsigStatus()
+	if err == nil {
+		return true
+	}
+	t := m.Extra[len(m.Extra)-1].(*dns.TSIG)
+	m.Rcode = dns.RcodeNotAuth
+	switch err {
+	case dns.ErrTime:
+		// signed, with the time of the server in other data.
+		t.Error = dns.RcodeBadTime
+		t.TimeSigned = tsig.TimeSigned
+		t.OtherLen = 6
+		t.OtherData = fmt.Sprintf("%012x", time.Now().Unix())
+	case dns.ErrSig:
+		t.Error = dns.RcodeBadSig
+	default:
+		t.Error = dns.RcodeBadKey
+	}
+	return false
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// updateTypes are the types which can be added by dynamic updates.
+var updateTypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeAAAA:  true,
+	dns.TypeCNAME: true,
+	dns.TypeTXT:   true,
+	dns.TypePTR:   true,
+	dns.TypeMX:    true,
+	dns.TypeSRV:   true,
+}
+
+// handleUpdate processes an RFC 2136 dynamic update. Records are added to
+// and deleted from the dynamic layer of the zone, which is kept across
+// netbox syncs, or written back to netbox when netbox.writeBack is set.
+func (zm *zoneManager) handleUpdate(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if !zm.ZoneConfig.DynamicUpdate || r.IsTsig() == nil || w.TsigStatus() != nil ||
+		!matchACL(w, r, zm.ZoneConfig.AllowUpdate, zm.ZoneConfig.UpdateKeys) {
+		m.SetRcode(r, dns.RcodeRefused)
+		writeLimited(w, r, m)
+		return
+	}
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+	if !strings.EqualFold(r.Question[0].Name, zm.ZoneConfig.Origin) {
+		m.SetRcode(r, dns.RcodeNotAuth)
+		w.WriteMsg(m)
+		return
+	}
+	tsig := r.IsTsig()
+	// updates are serialized from the prerequisites to their application,
+	// without holding the zone lock during the netbox write back.
+	zm.updateMu.Lock()
+	defer zm.updateMu.Unlock()
+	zm.mu.RLock()
+	rcode := zm.checkPrerequisites(r.Answer)
+	if rcode == dns.RcodeSuccess {
+		rcode = zm.checkUpdates(r.Ns)
+	}
+	zm.mu.RUnlock()
+	if rcode != dns.RcodeSuccess {
+		m.SetRcode(r, rcode)
+		w.WriteMsg(m)
+		return
+	}
+	// netbox is written first, so a failure leaves the zone untouched.
+	written, err := writeBack(config, r.Ns)
+	if err != nil {
+		log.Println(err)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+	if written {
+		requestSync()
+	}
+	updates := []dns.RR{}
+	for _, rr := range r.Ns {
+		// deletes also apply to the dynamic layer, which may hold records
+		// added before the write back was enabled.
+		if !isWriteBack(config, rr) || rr.Header().Class != dns.ClassINET {
+			updates = append(updates, rr)
+		}
+	}
+	zm.mu.Lock()
+	defer zm.mu.Unlock()
+	dynamic := mergeTree(newDNSTree(), &zm.Dynamic)
+	if zm.applyUpdates(dynamic, updates) {
+		zm.Dynamic = *dynamic
+		zm.commitTree(config, mergeTree(&zm.Base, dynamic))
+		log.Printf("dynamic update of %s by %s\n", zm.name(), tsig.Hdr.Name)
+	}
+	w.WriteMsg(m)
+}
+
+// checkPrerequisites evaluates the prerequisite section (RFC 2136 3.2).
+func (zm *zoneManager) checkPrerequisites(prereqs []dns.RR) int {
+	expected := map[string][]dns.RR{}
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		prefix, err := zm.getPrefixByOrigin(hdr.Name)
+		if err != nil {
+			return dns.RcodeNotZone
+		}
+		records := zm.Tree.Records[prefix]
+		inUse := len(records) != 0 || strings.EqualFold(hdr.Name, zm.ZoneConfig.Origin)
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rrtype == dns.TypeANY {
+				if !inUse {
+					return dns.RcodeNameError
+				}
+			} else if len(zm.rrset(hdr.Name, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rrtype == dns.TypeANY {
+				if inUse {
+					return dns.RcodeYXDomain
+				}
+			} else if len(zm.rrset(hdr.Name, hdr.Rrtype)) != 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := strings.ToLower(hdr.Name) + "/" + dns.TypeToString[hdr.Rrtype]
+			expected[key] = append(expected[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	for _, rrs := range expected {
+		actual := zm.rrset(rrs[0].Header().Name, rrs[0].Header().Rrtype)
+		if len(actual) != len(rrs) {
+			return dns.RcodeNXRrset
+		}
+		for _, rr := range rrs {
+			found := false
+			for _, a := range actual {
+				if dns.IsDuplicate(rr, a) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// rrset returns the records of type t at name, including the SOA and NS
+// records of the apex.
+func (zm *zoneManager) rrset(name string, t uint16) []dns.RR {
+	if strings.EqualFold(name, zm.ZoneConfig.Origin) {
+		switch t {
+		case dns.TypeSOA:
+			soa, _ := zm.getSOA(name)
+			return []dns.RR{soa}
+		case dns.TypeNS:
+			ns, _ := zm.getNS(name)
+			result := []dns.RR{}
+			for _, rr := range ns {
+				result = append(result, rr)
+			}
+			return result
+		}
+	}
+	prefix, err := zm.getPrefixByOrigin(name)
+	if err != nil {
+		return nil
+	}
+	result := []dns.RR{}
+	for _, record := range zm.Tree.Records[prefix] {
+		if record.DNSType == t {
+			if rr := zm.toRR(name, record); rr != nil {
+				result = append(result, rr)
+			}
+		}
+	}
+	return result
+}
+
+// checkUpdates prescans the update section (RFC 2136 3.4.1).
+func (zm *zoneManager) checkUpdates(updates []dns.RR) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if _, err := zm.getPrefixByOrigin(hdr.Name); err != nil {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			if !updateTypes[hdr.Rrtype] && hdr.Rrtype != dns.TypeSOA && hdr.Rrtype != dns.TypeNS {
+				return dns.RcodeNotImplemented
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+		if hdr.Class != dns.ClassINET && zm.deletesBase(rr) {
+			return dns.RcodeRefused
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// deletesBase reports whether the delete rr matches records of the base
+// layer, which come from the configuration or netbox and are not deleted by
+// updates. A and AAAA records of netbox are deleted there when written back.
+func (zm *zoneManager) deletesBase(rr dns.RR) bool {
+	prefix, _ := zm.getPrefixByOrigin(rr.Header().Name)
+	static := &dnsTree{Records: zm.ZoneConfig.Records}
+	for _, record := range zm.Base.Records[prefix] {
+		if !matchDelete(rr, record) {
+			continue
+		}
+		if isWriteBack(config, rr) && (record.DNSType == dns.TypeA || record.DNSType == dns.TypeAAAA) &&
+			!static.hasRecord(prefix, record) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// matchDelete reports whether the delete rr of an update section removes
+// record.
+func matchDelete(rr dns.RR, record dnsRecord) bool {
+	hdr := rr.Header()
+	if hdr.Class == dns.ClassANY {
+		return hdr.Rrtype == dns.TypeANY || record.DNSType == hdr.Rrtype
+	}
+	deleted, ok := toRecord(rr)
+	return ok && recordEqual(record, deleted)
+}
+
+// applyUpdates applies the update section to dynamic and reports whether
+// anything has changed. SOA and NS records of the apex come from the
+// configuration and are never changed.
+func (zm *zoneManager) applyUpdates(dynamic *dnsTree, updates []dns.RR) bool {
+	changed := false
+	for _, rr := range updates {
+		hdr := rr.Header()
+		prefix, _ := zm.getPrefixByOrigin(hdr.Name)
+		switch hdr.Class {
+		case dns.ClassINET:
+			record, ok := toRecord(rr)
+			if !ok || dynamic.hasRecord(prefix, record) {
+				continue
+			}
+			hasCNAME, hasOther := false, false
+			for _, r := range append(zm.Base.Records[prefix], dynamic.Records[prefix]...) {
+				if r.DNSType == dns.TypeCNAME {
+					hasCNAME = true
+				} else {
+					hasOther = true
+				}
+			}
+			if record.DNSType == dns.TypeCNAME && (hasOther || prefix == "") {
+				continue
+			}
+			if record.DNSType == dns.TypeCNAME && hasCNAME {
+				dynamic.removeRecords(prefix, func(r dnsRecord) bool {
+					return r.DNSType == dns.TypeCNAME
+				})
+			} else if record.DNSType != dns.TypeCNAME && hasCNAME {
+				continue
+			}
+			dynamic.addRecords(prefix, record)
+			changed = true
+		case dns.ClassANY, dns.ClassNONE:
+			if dynamic.removeRecords(prefix, func(r dnsRecord) bool {
+				return matchDelete(rr, r)
+			}) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// toRecord converts a resource record to a record of the tree.
+func toRecord(rr dns.RR) (dnsRecord, bool) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return dnsRecord{DNSType: dns.TypeA, A: rr.A}, true
+	case *dns.AAAA:
+		return dnsRecord{DNSType: dns.TypeAAAA, AAAA: rr.AAAA}, true
+	case *dns.CNAME:
+		return dnsRecord{DNSType: dns.TypeCNAME, CNAME: rr.Target}, true
+	case *dns.TXT:
+		return dnsRecord{DNSType: dns.TypeTXT, TXT: strings.Join(rr.Txt, "")}, true
+	case *dns.PTR:
+		return dnsRecord{DNSType: dns.TypePTR, PTR: rr.Ptr}, true
+	case *dns.MX:
+		return dnsRecord{DNSType: dns.TypeMX, MX: mxRecord{Preference: rr.Preference, Exchange: rr.Mx}}, true
+	case *dns.SRV:
+		return dnsRecord{DNSType: dns.TypeSRV, SRV: srvRecord{Priority: rr.Priority, Weight: rr.Weight, Port: rr.Port, Target: rr.Target}}, true
+	}
+	return dnsRecord{}, false
+}
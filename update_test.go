@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testUpdateZone returns a zone with the static records a and c.
+func testUpdateZone() *zoneManager {
+	records := map[string][]dnsRecord{
+		"a": {{DNSType: dns.TypeA, A: net.ParseIP("192.0.2.1")}},
+		"c": {{DNSType: dns.TypeCNAME, CNAME: "a.example.com."}},
+	}
+	zm := newTestZone("example.com.", records)
+	zm.ZoneConfig.Records = records
+	return zm
+}
+
+// prereq returns the prerequisite or delete of the RRset name/t in class.
+func prereq(name string, t uint16, class uint16) dns.RR {
+	return &dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: t, Class: class}}
+}
+
+func TestCheckPrerequisites(t *testing.T) {
+	tests := []struct {
+		name    string
+		prereqs []dns.RR
+		want    int
+	}{
+		{"name in use", []dns.RR{prereq("a.example.com.", dns.TypeANY, dns.ClassANY)}, dns.RcodeSuccess},
+		{"apex in use", []dns.RR{prereq("example.com.", dns.TypeANY, dns.ClassANY)}, dns.RcodeSuccess},
+		{"name not in use", []dns.RR{prereq("b.example.com.", dns.TypeANY, dns.ClassANY)}, dns.RcodeNameError},
+		{"name unused", []dns.RR{prereq("b.example.com.", dns.TypeANY, dns.ClassNONE)}, dns.RcodeSuccess},
+		{"name not unused", []dns.RR{prereq("a.example.com.", dns.TypeANY, dns.ClassNONE)}, dns.RcodeYXDomain},
+		{"rrset exists", []dns.RR{prereq("a.example.com.", dns.TypeA, dns.ClassANY)}, dns.RcodeSuccess},
+		{"apex soa exists", []dns.RR{prereq("example.com.", dns.TypeSOA, dns.ClassANY)}, dns.RcodeSuccess},
+		{"rrset does not exist", []dns.RR{prereq("a.example.com.", dns.TypeTXT, dns.ClassANY)}, dns.RcodeNXRrset},
+		{"rrset absent", []dns.RR{prereq("a.example.com.", dns.TypeTXT, dns.ClassNONE)}, dns.RcodeSuccess},
+		{"rrset not absent", []dns.RR{prereq("a.example.com.", dns.TypeA, dns.ClassNONE)}, dns.RcodeYXRrset},
+		{"rrset value", []dns.RR{mustRR("a.example.com. 0 IN A 192.0.2.1")}, dns.RcodeSuccess},
+		{"rrset other value", []dns.RR{mustRR("a.example.com. 0 IN A 192.0.2.2")}, dns.RcodeNXRrset},
+		{"rrset more values", []dns.RR{
+			mustRR("a.example.com. 0 IN A 192.0.2.1"),
+			mustRR("a.example.com. 0 IN A 192.0.2.2"),
+		}, dns.RcodeNXRrset},
+		{"ttl", []dns.RR{mustRR("a.example.com. 60 IN A 192.0.2.1")}, dns.RcodeFormatError},
+		{"not zone", []dns.RR{prereq("a.example.org.", dns.TypeANY, dns.ClassANY)}, dns.RcodeNotZone},
+		{"first failure", []dns.RR{
+			prereq("a.example.com.", dns.TypeANY, dns.ClassANY),
+			prereq("a.example.com.", dns.TypeA, dns.ClassNONE),
+		}, dns.RcodeYXRrset},
+	}
+	zm := testUpdateZone()
+	for _, tt := range tests {
+		if got := zm.checkPrerequisites(tt.prereqs); got != tt.want {
+			t.Errorf("%s: checkPrerequisites = %s, want %s", tt.name, dns.RcodeToString[got], dns.RcodeToString[tt.want])
+		}
+	}
+}
+
+func TestCheckUpdates(t *testing.T) {
+	tests := []struct {
+		name      string
+		updates   []dns.RR
+		writeBack bool
+		want      int
+	}{
+		{"add", []dns.RR{mustRR("b.example.com. 60 IN TXT b")}, false, dns.RcodeSuccess},
+		{"add unsupported type", []dns.RR{mustRR("b.example.com. 60 IN HINFO a b")}, false, dns.RcodeNotImplemented},
+		{"not zone", []dns.RR{mustRR("b.example.org. 60 IN TXT b")}, false, dns.RcodeNotZone},
+		{"delete dynamic rrset", []dns.RR{prereq("t.example.com.", dns.TypeTXT, dns.ClassANY)}, false, dns.RcodeSuccess},
+		{"delete dynamic record", []dns.RR{mustRR("t.example.com. 0 NONE TXT old")}, false, dns.RcodeSuccess},
+		{"delete base name", []dns.RR{prereq("a.example.com.", dns.TypeANY, dns.ClassANY)}, false, dns.RcodeRefused},
+		{"delete base rrset", []dns.RR{prereq("c.example.com.", dns.TypeCNAME, dns.ClassANY)}, false, dns.RcodeRefused},
+		{"delete base record", []dns.RR{mustRR("a.example.com. 0 NONE A 192.0.2.1")}, false, dns.RcodeRefused},
+		{"delete other base record", []dns.RR{mustRR("a.example.com. 0 NONE A 192.0.2.9")}, false, dns.RcodeSuccess},
+		{"delete with ttl", []dns.RR{mustRR("t.example.com. 60 NONE TXT old")}, false, dns.RcodeFormatError},
+		{"delete netbox record", []dns.RR{mustRR("n.example.com. 0 NONE A 192.0.2.3")}, false, dns.RcodeRefused},
+		{"write back netbox record", []dns.RR{mustRR("n.example.com. 0 NONE A 192.0.2.3")}, true, dns.RcodeSuccess},
+		{"write back netbox name", []dns.RR{prereq("n.example.com.", dns.TypeANY, dns.ClassANY)}, true, dns.RcodeSuccess},
+		{"write back static record", []dns.RR{mustRR("a.example.com. 0 NONE A 192.0.2.1")}, true, dns.RcodeRefused},
+	}
+	zm := testUpdateZone()
+	zm.Base.addRecords("n", dnsRecord{DNSType: dns.TypeA, A: net.ParseIP("192.0.2.3")})
+	zm.Dynamic.addRecords("t", dnsRecord{DNSType: dns.TypeTXT, TXT: "old"})
+	defer func(writeBack bool) { config.Netbox.WriteBack = writeBack }(config.Netbox.WriteBack)
+	for _, tt := range tests {
+		config.Netbox.WriteBack = tt.writeBack
+		if got := zm.checkUpdates(tt.updates); got != tt.want {
+			t.Errorf("%s: checkUpdates = %s, want %s", tt.name, dns.RcodeToString[got], dns.RcodeToString[tt.want])
+		}
+	}
+}
+
+func TestApplyUpdates(t *testing.T) {
+	cname := func(target string) []dnsRecord {
+		return []dnsRecord{{DNSType: dns.TypeCNAME, CNAME: target}}
+	}
+	txt := []dnsRecord{{DNSType: dns.TypeTXT, TXT: "old"}}
+	tests := []struct {
+		name    string
+		updates []dns.RR
+		changed bool
+		want    map[string][]dnsRecord
+	}{
+		{"add", []dns.RR{mustRR("b.example.com. 60 IN A 192.0.2.2")}, true, map[string][]dnsRecord{
+			"b": {{DNSType: dns.TypeA, A: net.ParseIP("192.0.2.2")}},
+			"d": cname("x.example.net."),
+			"t": txt,
+		}},
+		{"add existing", []dns.RR{mustRR("t.example.com. 60 IN TXT old")}, false, map[string][]dnsRecord{
+			"d": cname("x.example.net."),
+			"t": txt,
+		}},
+		{"cname beside other data", []dns.RR{mustRR("a.example.com. 60 IN CNAME b.example.com.")}, false, map[string][]dnsRecord{
+			"d": cname("x.example.net."),
+			"t": txt,
+		}},
+		{"cname at the apex", []dns.RR{mustRR("example.com. 60 IN CNAME b.example.com.")}, false, map[string][]dnsRecord{
+			"d": cname("x.example.net."),
+			"t": txt,
+		}},
+		{"other data beside base cname", []dns.RR{mustRR("c.example.com. 60 IN A 192.0.2.2")}, false, map[string][]dnsRecord{
+			"d": cname("x.example.net."),
+			"t": txt,
+		}},
+		{"other data beside cname", []dns.RR{mustRR("d.example.com. 60 IN TXT d")}, false, map[string][]dnsRecord{
+			"d": cname("x.example.net."),
+			"t": txt,
+		}},
+		{"cname replaces cname", []dns.RR{mustRR("d.example.com. 60 IN CNAME y.example.net.")}, true, map[string][]dnsRecord{
+			"d": cname("y.example.net."),
+			"t": txt,
+		}},
+		{"delete rrset", []dns.RR{prereq("t.example.com.", dns.TypeTXT, dns.ClassANY)}, true, map[string][]dnsRecord{
+			"d": cname("x.example.net."),
+		}},
+		{"delete name", []dns.RR{prereq("d.example.com.", dns.TypeANY, dns.ClassANY)}, true, map[string][]dnsRecord{
+			"t": txt,
+		}},
+		{"delete record", []dns.RR{mustRR("t.example.com. 0 NONE TXT old")}, true, map[string][]dnsRecord{
+			"d": cname("x.example.net."),
+		}},
+		{"delete missing record", []dns.RR{mustRR("t.example.com. 0 NONE TXT new")}, false, map[string][]dnsRecord{
+			"d": cname("x.example.net."),
+			"t": txt,
+		}},
+		{"delete then add", []dns.RR{
+			prereq("d.example.com.", dns.TypeCNAME, dns.ClassANY),
+			mustRR("d.example.com. 60 IN TXT d"),
+		}, true, map[string][]dnsRecord{
+			"d": {{DNSType: dns.TypeTXT, TXT: "d"}},
+			"t": txt,
+		}},
+	}
+	for _, tt := range tests {
+		zm := testUpdateZone()
+		dynamic := newDNSTree()
+		dynamic.addRecords("d", cname("x.example.net.")[0])
+		dynamic.addRecords("t", txt[0])
+		if changed := zm.applyUpdates(dynamic, tt.updates); changed != tt.changed {
+			t.Errorf("%s: changed = %v, want %v", tt.name, changed, tt.changed)
+		}
+		if !reflect.DeepEqual(dynamic.Records, tt.want) {
+			t.Errorf("%s: records = %v, want %v", tt.name, dynamic.Records, tt.want)
+		}
+	}
+}
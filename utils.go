@@ -3,23 +3,29 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math/bits"
 	"math/rand"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/miekg/dns"
 )
 
 func zoneMerge(zoneConfig *zoneConfig, zoneDefaultConfig *zoneDefaultConfig) (*zone, error) {
-	var fqdn string = dns.Fqdn(zoneConfig.Suffix)
+	var fqdn string = dns.CanonicalName(zoneConfig.Suffix)
+	if err := validateReverseSuffix(fqdn); err != nil {
+		return nil, err
+	}
 	var origin string
 	var soaNS, mBox string
 	var ttl, refresh, retry, expire, minTTL uint32
-	var allowTransfer []string
 	var ns []string = []string{}
 	if zoneConfig.Origin != nil {
-		origin = dns.Fqdn(*zoneConfig.Origin)
+		origin = dns.CanonicalName(*zoneConfig.Origin)
 	} else {
-		origin = dns.Fqdn(zoneConfig.Suffix)
+		origin = dns.CanonicalName(zoneConfig.Suffix)
 	}
 	if zoneConfig.TTL != nil {
 		ttl = *zoneConfig.TTL
@@ -81,16 +87,105 @@ func zoneMerge(zoneConfig *zoneConfig, zoneDefaultConfig *zoneDefaultConfig) (*z
 	} else {
 		return nil, fmt.Errorf("soa.minTTL not found")
 	}
+	allowTransferStrs := []string{}
 	if zoneConfig.AllowTransfer != nil {
-		allowTransfer = *zoneConfig.AllowTransfer
+		allowTransferStrs = *zoneConfig.AllowTransfer
 	} else if zoneDefaultConfig.AllowTransfer != nil {
-		allowTransfer = *zoneDefaultConfig.AllowTransfer
-	} else {
-		allowTransfer = []string{}
+		allowTransferStrs = *zoneDefaultConfig.AllowTransfer
+	}
+	allowTransfer, err := parseNetworks(allowTransferStrs)
+	if err != nil {
+		return nil, fmt.Errorf("allowTransfer: %s", err)
+	}
+	transferKeys := []string{}
+	if zoneConfig.TransferKeys != nil {
+		transferKeys = canonicalNames(*zoneConfig.TransferKeys)
+	} else if zoneDefaultConfig.TransferKeys != nil {
+		transferKeys = canonicalNames(*zoneDefaultConfig.TransferKeys)
+	}
+	updateKeys := []string{}
+	if zoneConfig.UpdateKeys != nil {
+		updateKeys = canonicalNames(*zoneConfig.UpdateKeys)
+	}
+	allowUpdate := []*net.IPNet{}
+	if zoneConfig.AllowUpdate != nil {
+		if allowUpdate, err = parseNetworks(*zoneConfig.AllowUpdate); err != nil {
+			return nil, fmt.Errorf("allowUpdate: %s", err)
+		}
+	}
+	notify := notify{Targets: []string{}}
+	for _, nc := range []*notifyConfig{zoneDefaultConfig.Notify, zoneConfig.Notify} {
+		if nc == nil {
+			continue
+		}
+		if nc.Targets != nil {
+			notify.Targets = []string{}
+			for _, target := range *nc.Targets {
+				if _, _, err := net.SplitHostPort(target); err != nil {
+					target = net.JoinHostPort(target, "53")
+				}
+				notify.Targets = append(notify.Targets, target)
+			}
+		}
+		if nc.AllowTransfer != nil {
+			notify.AllowTransfer = *nc.AllowTransfer
+		}
+		if nc.TsigKey != nil {
+			notify.TsigKey = dns.Fqdn(*nc.TsigKey)
+		}
+	}
+	transferTLS := transferTLS{ClientCertificates: []string{}}
+	for _, tc := range []*transferTLSConfig{zoneDefaultConfig.TransferTLS, zoneConfig.TransferTLS} {
+		if tc == nil {
+			continue
+		}
+		if tc.Require != nil {
+			transferTLS.Require = *tc.Require
+		}
+		if tc.ClientCertificates != nil {
+			transferTLS.ClientCertificates = []string{}
+			for _, fingerprint := range *tc.ClientCertificates {
+				fingerprint = strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+				transferTLS.ClientCertificates = append(transferTLS.ClientCertificates, fingerprint)
+			}
+		}
+		if tc.TsigKey != nil {
+			transferTLS.TsigKey = dns.Fqdn(*tc.TsigKey)
+		}
 	}
 	records := map[string][]dnsRecord{}
 	if zoneConfig.Records != nil {
 		for _, zc := range *zoneConfig.Records {
+			if zc.Name == "@" {
+				zc.Name = ""
+			}
+			zc.Name = strings.ToLower(zc.Name)
+			if zc.A != nil {
+				ip := net.ParseIP(*zc.A)
+				if ip == nil || ip.To4() == nil {
+					return nil, fmt.Errorf("invalid a record: %s", *zc.A)
+				}
+				records[zc.Name] = append(records[zc.Name], dnsRecord{
+					DNSType: dns.TypeA,
+					A:       ip.To4(),
+				})
+			}
+			if zc.AAAA != nil {
+				ip := net.ParseIP(*zc.AAAA)
+				if ip == nil || ip.To4() != nil {
+					return nil, fmt.Errorf("invalid aaaa record: %s", *zc.AAAA)
+				}
+				records[zc.Name] = append(records[zc.Name], dnsRecord{
+					DNSType: dns.TypeAAAA,
+					AAAA:    ip,
+				})
+			}
+			if zc.ALIAS != nil {
+				records[zc.Name] = append(records[zc.Name], dnsRecord{
+					DNSType: typeALIAS,
+					ALIAS:   toFQDN(*zc.ALIAS, fqdn),
+				})
+			}
 			if zc.CNAME != nil {
 				_, ok := records[zc.Name]
 				if !ok {
@@ -111,6 +206,61 @@ func zoneMerge(zoneConfig *zoneConfig, zoneDefaultConfig *zoneDefaultConfig) (*z
 					TXT:     *zc.TXT,
 				})
 			}
+			if zc.NS != nil {
+				if zc.Name == "" {
+					return nil, fmt.Errorf("ns record of the apex: use ns instead")
+				}
+				_, ok := records[zc.Name]
+				if !ok {
+					records[zc.Name] = []dnsRecord{}
+				}
+				records[zc.Name] = append(records[zc.Name], dnsRecord{
+					DNSType: dns.TypeNS,
+					NS:      toFQDN(*zc.NS, fqdn),
+				})
+			}
+			if zc.MX != nil {
+				_, ok := records[zc.Name]
+				if !ok {
+					records[zc.Name] = []dnsRecord{}
+				}
+				records[zc.Name] = append(records[zc.Name], dnsRecord{
+					DNSType: dns.TypeMX,
+					MX: mxRecord{
+						Preference: zc.MX.Preference,
+						Exchange:   toFQDN(zc.MX.Exchange, fqdn),
+					},
+				})
+			}
+			if zc.SRV != nil {
+				_, ok := records[zc.Name]
+				if !ok {
+					records[zc.Name] = []dnsRecord{}
+				}
+				records[zc.Name] = append(records[zc.Name], dnsRecord{
+					DNSType: dns.TypeSRV,
+					SRV: srvRecord{
+						Priority: zc.SRV.Priority,
+						Weight:   zc.SRV.Weight,
+						Port:     zc.SRV.Port,
+						Target:   toFQDN(zc.SRV.Target, fqdn),
+					},
+				})
+			}
+		}
+	}
+	for name, rr := range records {
+		aliases, others := 0, 0
+		for _, record := range rr {
+			switch record.DNSType {
+			case typeALIAS:
+				aliases++
+			case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME:
+				others++
+			}
+		}
+		if aliases > 1 || aliases == 1 && others != 0 {
+			return nil, fmt.Errorf("alias record of %q: no other alias, a, aaaa or cname allowed", name)
 		}
 	}
 	return &zone{
@@ -128,9 +278,72 @@ func zoneMerge(zoneConfig *zoneConfig, zoneDefaultConfig *zoneDefaultConfig) (*z
 		TTL:           ttl,
 		NS:            ns,
 		AllowTransfer: allowTransfer,
+		TransferKeys:  transferKeys,
+		DNSSEC:        zoneConfig.DNSSEC,
+		Notify:        notify,
+		TransferTLS:   transferTLS,
+		DynamicUpdate: zoneConfig.DynamicUpdate != nil && *zoneConfig.DynamicUpdate,
+		UpdateKeys:    updateKeys,
+		AllowUpdate:   allowUpdate,
 	}, nil
 }
 
+func canonicalNames(names []string) []string {
+	result := []string{}
+	for _, name := range names {
+		result = append(result, dns.CanonicalName(name))
+	}
+	return result
+}
+
+// validateReverseSuffix checks that a zone under in-addr.arpa. or ip6.arpa.
+// is cut on an octet (IPv4) or nibble (IPv6) boundary.
+func validateReverseSuffix(fqdn string) error {
+	labels := dns.SplitDomainName(strings.ToLower(fqdn))
+	switch {
+	case dns.IsSubDomain("in-addr.arpa.", strings.ToLower(fqdn)):
+		if len(labels) > 6 {
+			return fmt.Errorf("invalid reverse zone: %s", fqdn)
+		}
+		for _, label := range labels[:len(labels)-2] {
+			octet, err := strconv.Atoi(label)
+			if err != nil || octet < 0 || octet > 255 {
+				return fmt.Errorf("invalid reverse zone: %s", fqdn)
+			}
+		}
+	case dns.IsSubDomain("ip6.arpa.", strings.ToLower(fqdn)):
+		if len(labels) > 34 {
+			return fmt.Errorf("invalid reverse zone: %s", fqdn)
+		}
+		for _, label := range labels[:len(labels)-2] {
+			if len(label) != 1 || !strings.Contains("0123456789abcdef", label) {
+				return fmt.Errorf("invalid reverse zone: %s", fqdn)
+			}
+		}
+	}
+	return nil
+}
+
+// isHostname reports whether name looks like a host name that can be used
+// as a PTR target. Descriptions in netbox are free text, so anything else is
+// skipped.
+func isHostname(name string) bool {
+	if name == "." {
+		return false
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return false
+	}
+	for _, label := range dns.SplitDomainName(name) {
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func toFQDN(name string, zone string) string {
 	if dns.IsFqdn(name) {
 		return name
@@ -138,7 +351,9 @@ func toFQDN(name string, zone string) string {
 	return fmt.Sprintf("%s.%s", name, zone)
 }
 
-func sortRR(rr []dns.RR, rnd bool) {
+// sortRR shuffles rr when rnd is set and, given the client address, moves
+// the A and AAAA records sharing the longest prefix with it to the front.
+func sortRR(rr []dns.RR, rnd bool, client net.IP) {
 	if rnd {
 		i := 0
 		for j := 0; j < len(rr); j++ {
@@ -160,9 +375,78 @@ func sortRR(rr []dns.RR, rnd bool) {
 			k := rand.Intn(j + 1)
 			rr[j], rr[k] = rr[k], rr[j]
 		}
-	} else {
+	}
+	if client == nil {
+		return
+	}
+	index := []int{}
+	addresses := []dns.RR{}
+	for i, r := range rr {
+		switch r.(type) {
+		case *dns.A, *dns.AAAA:
+			index = append(index, i)
+			addresses = append(addresses, r)
+		}
+	}
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return commonPrefix(addresses[i], client) > commonPrefix(addresses[j], client)
+	})
+	for n, i := range index {
+		rr[i] = addresses[n]
+	}
+}
 
+// commonPrefix returns the number of leading bits shared by the address of
+// rr and client, which is 0 for different address families.
+func commonPrefix(rr dns.RR, client net.IP) int {
+	var ip net.IP
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip, client = rr.A.To4(), client.To4()
+	case *dns.AAAA:
+		if client.To4() != nil {
+			return 0
+		}
+		ip, client = rr.AAAA.To16(), client.To16()
+	}
+	if ip == nil || client == nil || len(ip) != len(client) {
+		return 0
+	}
+	for i := range ip {
+		if x := ip[i] ^ client[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(ip) * 8
+}
+
+// addExtra inserts rr into the additional section in front of the OPT and
+// TSIG records, which have to stay at the end of the message.
+func addExtra(m *dns.Msg, rr ...dns.RR) {
+	i := len(m.Extra)
+	for i > 0 {
+		t := m.Extra[i-1].Header().Rrtype
+		if t != dns.TypeOPT && t != dns.TypeTSIG {
+			break
+		}
+		i--
+	}
+	extra := append([]dns.RR{}, m.Extra[:i]...)
+	extra = append(extra, rr...)
+	m.Extra = append(extra, m.Extra[i:]...)
+}
+
+// parseNetworks parses a list of networks in CIDR notation.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	result := []*net.IPNet{}
+	for _, network := range networks {
+		_, subnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, subnet)
 	}
+	return result, nil
 }
 
 func parseIP(s string) (net.IP, error) {
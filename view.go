@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// view is a split-horizon view of the zones, selected by the address of the
+// client and filled with the netbox ip addresses matching its filter.
+type view struct {
+	Name   string
+	Match  []*net.IPNet
+	VRF    string
+	Tag    string
+	Prefix *net.IPNet
+}
+
+// views are the configured views in the order of matching. It is empty when
+// the zones are not split.
+var views []*view
+
+func parseViews(viewConfigs []viewConfig) ([]*view, error) {
+	result := []*view{}
+	names := map[string]bool{}
+	for _, vc := range viewConfigs {
+		if vc.Name == "" || names[vc.Name] {
+			return nil, fmt.Errorf("invalid view name: %q", vc.Name)
+		}
+		names[vc.Name] = true
+		v := &view{Name: vc.Name, Match: []*net.IPNet{}}
+		for _, matchStr := range vc.Match {
+			_, subnet, err := net.ParseCIDR(matchStr)
+			if err != nil {
+				return nil, err
+			}
+			v.Match = append(v.Match, subnet)
+		}
+		if vc.Netbox.VRF != nil {
+			v.VRF = *vc.Netbox.VRF
+		}
+		if vc.Netbox.Tag != nil {
+			v.Tag = *vc.Netbox.Tag
+		}
+		if vc.Netbox.Prefix != nil {
+			_, subnet, err := net.ParseCIDR(*vc.Netbox.Prefix)
+			if err != nil {
+				return nil, err
+			}
+			v.Prefix = subnet
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// selectView returns the first view matching the client address ip, which
+// is nil when no views are configured. It fails when no view matches.
+func selectView(ip net.IP) (*view, bool) {
+	if len(views) == 0 {
+		return nil, true
+	}
+	if ip == nil {
+		return nil, false
+	}
+	for _, v := range views {
+		for _, subnet := range v.Match {
+			if subnet.Contains(ip) {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// matchAddress reports whether a netbox ip address belongs to the view. A nil
+// view has every address.
+func (v *view) matchAddress(address *ipAddress, ip net.IP) bool {
+	if v == nil {
+		return true
+	}
+	if v.VRF != "" && (address.VRF == nil || address.VRF.Name != v.VRF && address.VRF.RD != v.VRF) {
+		return false
+	}
+	if v.Tag != "" {
+		found := false
+		for _, tag := range address.Tags {
+			if tag.Name == v.Tag || tag.Slug == v.Tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if v.Prefix != nil && !v.Prefix.Contains(ip) {
+		return false
+	}
+	return true
+}
+
+// viewSelector passes the queries of a zone to the zone manager of the view
+// selected by the client.
+type viewSelector map[*view]*zoneManager
+
+func (zms viewSelector) handler(w dns.ResponseWriter, r *dns.Msg) {
+	v, ok := selectView(clientIP(w, r))
+	zm, found := zms[v]
+	if !ok || !found {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		setEdns(r, m)
+		writeLimited(w, r, m)
+		return
+	}
+	setQueryView(w, v, zm.ZoneConfig.Origin)
+	zm.handler(w, r)
+}
@@ -35,6 +35,7 @@ func getHandler(ch chan struct{}, ts string, allowFrom []*net.IPNet) (func(w htt
 			return
 		}
 		log.Println("webhook received")
+		webhookTriggers.add(1)
 		access = time.Now()
 		w.Write([]byte{})
 		go func() {
@@ -48,7 +49,9 @@ func getHandler(ch chan struct{}, ts string, allowFrom []*net.IPNet) (func(w htt
 	}, nil
 }
 
-func startListen(wc *webhookConfig) (chan struct{}, error) {
+// startListen starts the webhook listener, which also serves handlers, and
+// returns the channel notified by the webhook.
+func startListen(wc *webhookConfig, handlers map[string]http.Handler) (chan struct{}, error) {
 	ch := make(chan struct{})
 	mux := http.NewServeMux()
 	if wc.Timeout == "" {
@@ -67,6 +70,9 @@ func startListen(wc *webhookConfig) (chan struct{}, error) {
 		return nil, err
 	}
 	mux.Handle("/", http.HandlerFunc(handler))
+	for path, h := range handlers {
+		mux.Handle(path, h)
+	}
 	srv := &http.Server{
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"net"
 	"sort"
 	"strings"
@@ -18,197 +19,429 @@ type zone struct {
 	TTL           uint32                 `yaml:"ttl"`
 	NS            []string               `yaml:"ns"`
 	Records       map[string][]dnsRecord `yaml:"records"`
-	AllowTransfer []string               `yaml:"allowTransfer"`
+	AllowTransfer []*net.IPNet           `yaml:"allowTransfer"`
+	TransferKeys  []string               `yaml:"transferKeys"`
+	DNSSEC        *dnssecConfig          `yaml:"dnssec"`
+	Notify        notify                 `yaml:"notify"`
+	TransferTLS   transferTLS            `yaml:"transferTLS"`
+	DynamicUpdate bool                   `yaml:"dynamicUpdate"`
+	UpdateKeys    []string               `yaml:"updateKeys"`
+	AllowUpdate   []*net.IPNet           `yaml:"allowUpdate"`
+	View          *view                  `yaml:"view"`
 }
 
+var transferChunk = 500
+
 func newZoneManager(zone *zone) *zoneManager {
 	return &zoneManager{
 		ZoneConfig: *zone,
 		Serial:     serial{},
 		Tree:       dnsTree{},
+		Base:       dnsTree{},
+		Dynamic:    *newDNSTree(),
 	}
 }
 
 type zoneManager struct {
 	ZoneConfig zone
 	Serial     serial
-	Tree       dnsTree
+	// Tree is what is served, Base plus Dynamic.
+	Tree dnsTree
+	// Base holds the static and netbox records of the last sync.
+	Base dnsTree
+	// Dynamic holds the records added by dynamic updates.
+	Dynamic   dnsTree
+	Signer    *zoneSigner
+	Journal   []journalEntry
+	DataStore dataStore
+
+	mu sync.RWMutex
+	// updateMu serializes dynamic updates.
+	updateMu sync.Mutex
 }
 
 func (zm *zoneManager) handler(w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Response = true
-	m.SetEdns0(4096, true)
-
-	if r.IsTsig() != nil {
-		name := r.Extra[len(r.Extra)-1].(*dns.TSIG).Hdr.Name
-		if w.TsigStatus() == nil {
-			m.SetTsig(name, dns.HmacMD5, 300, time.Now().Unix())
-		} else {
-			// TODO: 正しい応答法がワカラン
-			// m.SetTsig(name, dns.HmacMD5, 300, time.Now().Unix())
-			// BADKEYなど
-			w.WriteMsg(m)
-			return
+	if rcode := checkEdns(r); rcode != dns.RcodeSuccess {
+		m.Rcode = rcode
+		if rcode == dns.RcodeBadVers {
+			m.SetEdns0(maxUDPSize, false)
 		}
+		writeLimited(w, r, m)
+		return
+	}
+	setEdns(r, m)
+
+	if !setTsig(w, r, m) {
+		writeLimited(w, r, m)
+		return
+	}
+
+	if r.Opcode == dns.OpcodeUpdate {
+		zm.handleUpdate(w, r, m)
+		return
 	}
 
+	aliases, cnames, written := zm.answer(w, r, m)
+	if written {
+		return
+	}
+	// ALIAS targets are flattened and CNAME chains followed without the
+	// lock, as they may lead to any zone or upstream.
+	v := zm.ZoneConfig.View
+	flattened := make([][]dns.RR, len(aliases))
+	chains := make([]*cnameChain, len(cnames))
+	var err error
+	for i, a := range aliases {
+		seen := map[string]bool{strings.ToLower(a.name): true}
+		if flattened[i], err = flattenAlias(a, v, zm.ZoneConfig.TTL, seen); err != nil {
+			break
+		}
+	}
+	opt := r.IsEdns0()
+	for i, c := range cnames {
+		if err != nil {
+			break
+		}
+		seen := map[string]bool{strings.ToLower(c.name): true}
+		chains[i], err = followCNAME(c.target, c.qtype, v, opt != nil && opt.Do(), seen)
+	}
+	zm.mu.RLock()
+	defer zm.mu.RUnlock()
+	if err != nil {
+		log.Println(err)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		m.Authoritative = false
+		zm.writeMsg(w, r, m)
+		return
+	}
+	for _, rr := range flattened {
+		if len(rr) == 0 {
+			m.Ns = append(m.Ns, zm.getSOAonError())
+			continue
+		}
+		sortRR(rr, false, clientIP(w, r))
+		m.Answer = append(m.Answer, rr...)
+	}
+	for _, chain := range chains {
+		m.Answer = append(m.Answer, chain.answer...)
+		m.Ns = append(m.Ns, chain.ns...)
+		if chain.rcode != dns.RcodeSuccess {
+			m.Rcode = chain.rcode
+		}
+	}
+	zm.writeMsg(w, r, m)
+}
+
+// answer adds the answers to the questions of r to m, except for those
+// answered by an ALIAS or continued by a CNAME chain, which are returned. It
+// tells whether the response has been written already.
+func (zm *zoneManager) answer(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) ([]aliasQuery, []cnameQuery, bool) {
+	zm.mu.RLock()
+	defer zm.mu.RUnlock()
 	m.Authoritative = true
+	aliases := []aliasQuery{}
+	cnames := []cnameQuery{}
 	for _, q := range r.Question {
-		results, cnameAllLen := zm.resolve(q.Name, []uint16{dns.TypeCNAME}, false)
+		if _, err := zm.getPrefixByOrigin(q.Name); err != nil {
+			m.Authoritative = false
+			m.SetRcode(r, dns.RcodeRefused)
+			zm.writeMsg(w, r, m)
+			return nil, nil, true
+		}
+		if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+			zm.handleTransfer(w, r, m, q)
+			return nil, nil, true
+		}
+		if zm.referral(m, q) {
+			zm.writeMsg(w, r, m)
+			return nil, nil, true
+		}
+		results, _ := zm.resolve(q.Name, []uint16{dns.TypeCNAME}, false)
 		if len(results) != 0 {
-			m.Answer = append(m.Ns, results[0])
-			if q.Qtype != dns.TypeCNAME {
-				cname := *results[0].(*dns.CNAME)
-				glues, allLen := zm.resolve(cname.Target, []uint16{q.Qtype}, false)
-				if allLen != 0 {
-					for _, glue := range glues {
-						m.Answer = append(m.Answer, glue)
-					}
-				}
+			m.Answer = append(m.Answer, results[0])
+			if q.Qtype != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+				cnames = append(cnames, cnameQuery{name: q.Name, target: results[0].(*dns.CNAME).Target, qtype: q.Qtype})
 			}
-			w.WriteMsg(m)
-			return
+			continue
 		}
-		switch q.Qtype {
-		case dns.TypeSOA:
-			soa, err := zm.getSOA(q.Name)
-			if err != nil {
-				m.Ns = append(m.Ns, zm.getSOAonError())
-				w.WriteMsg(m)
-				return
-			}
-			m.Answer = append(m.Answer, soa)
-		case dns.TypeNS:
-			nss, err := zm.getNS(q.Name)
-			if err != nil {
-				m.Ns = append(m.Ns, zm.getSOAonError())
-				w.WriteMsg(m)
-				return
-			}
-			for _, ns := range nss {
-				m.Answer = append(m.Answer, ns)
-				sortRR(m.Answer, true)
-			}
-		case dns.TypeA:
-			results, allLen := zm.resolve(q.Name, []uint16{dns.TypeA}, false)
-			if len(results) == 0 {
-				if allLen == 0 {
-					m.SetRcode(r, dns.RcodeNameError)
-				} else {
-					m.SetRcode(r, dns.RcodeSuccess)
-				}
-				m.Ns = append(m.Ns, zm.getSOAonError())
-				w.WriteMsg(m)
-				return
-			}
-			for _, result := range results {
-				m.Answer = append(m.Answer, result)
-			}
-		case dns.TypeAAAA:
-			results, allLen := zm.resolve(q.Name, []uint16{dns.TypeAAAA}, false)
-			if len(results) == 0 {
-				if allLen == 0 {
-					m.SetRcode(r, dns.RcodeNameError)
-				} else {
-					m.SetRcode(r, dns.RcodeSuccess)
-				}
-				m.Ns = append(m.Ns, zm.getSOAonError())
-				w.WriteMsg(m)
-				return
-			}
-			for _, result := range results {
-				m.Answer = append(m.Answer, result)
-			}
-		case dns.TypeTXT:
-			results, allLen := zm.resolve(q.Name, []uint16{dns.TypeTXT}, false)
-			if len(results) == 0 {
-				if allLen == 0 {
-					m.SetRcode(r, dns.RcodeNameError)
-				} else {
-					m.SetRcode(r, dns.RcodeSuccess)
-				}
-				m.Ns = append(m.Ns, zm.getSOAonError())
-				w.WriteMsg(m)
-				return
-			}
-			for _, result := range results {
-				m.Answer = append(m.Answer, result)
+		results, exists := zm.lookup(q.Name, q.Qtype)
+		if len(results) == 0 && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+			if target, ok := zm.getAlias(q.Name); ok {
+				aliases = append(aliases, aliasQuery{name: q.Name, target: target, qtype: q.Qtype})
+				continue
 			}
-		case dns.TypeAXFR:
-			allowTransfer := []*net.IPNet{}
-			for _, allowStr := range zm.ZoneConfig.AllowTransfer {
-				_, subnet, err := net.ParseCIDR(allowStr)
-				if err != nil {
-					w.WriteMsg(m)
-					return
-				}
-				allowTransfer = append(allowTransfer, subnet)
+		}
+		if len(results) == 0 {
+			if !exists {
+				m.SetRcode(r, dns.RcodeNameError)
 			}
+			m.Ns = append(m.Ns, zm.getSOAonError())
+			zm.writeMsg(w, r, m)
+			return nil, nil, true
+		}
+		sortRR(results, false, clientIP(w, r))
+		m.Answer = append(m.Answer, results...)
+		zm.additional(m, results)
+	}
+	return aliases, cnames, false
+}
 
-			ip, err := parseIP(w.RemoteAddr().String())
-			if err != nil {
-				w.WriteMsg(m)
-				return
-			}
-			allowFlag := false
-			for _, allow := range allowTransfer {
-				if allow.Contains(ip) {
-					allowFlag = true
-					break
-				}
-			}
-			if !allowFlag {
-				w.WriteMsg(m)
-				return
-			}
-			if zm.ZoneConfig.Origin != q.Name {
-				w.WriteMsg(m)
-				return
-			}
-			ch := make(chan *dns.Envelope)
-			tr := new(dns.Transfer)
-			var wg sync.WaitGroup
-			go func() {
-				wg.Add(1)
-				tr.Out(w, r, ch)
-				wg.Done()
-			}()
-			soa, err := zm.getSOA(zm.ZoneConfig.Origin)
-			if err != nil {
-				w.WriteMsg(m)
-				return
+// handleTransfer answers AXFR and IXFR requests.
+func (zm *zoneManager) handleTransfer(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, q dns.Question) {
+	if !zm.allowTransfer(w, r) || !zm.allowTransferTLS(w, r) {
+		m.SetRcode(r, dns.RcodeRefused)
+		zm.writeMsg(w, r, m)
+		return
+	}
+	if !strings.EqualFold(q.Name, zm.ZoneConfig.Origin) {
+		m.SetRcode(r, dns.RcodeNotAuth)
+		zm.writeMsg(w, r, m)
+		return
+	}
+	soa, err := zm.getSOA(zm.ZoneConfig.Origin)
+	if err != nil {
+		m.SetRcode(r, dns.RcodeServerFailure)
+		zm.writeMsg(w, r, m)
+		return
+	}
+	var rr []dns.RR
+	if q.Qtype == dns.TypeIXFR {
+		if len(r.Ns) == 0 {
+			m.SetRcode(r, dns.RcodeFormatError)
+			zm.writeMsg(w, r, m)
+			return
+		}
+		clientSOA, ok := r.Ns[0].(*dns.SOA)
+		if !ok {
+			m.SetRcode(r, dns.RcodeFormatError)
+			zm.writeMsg(w, r, m)
+			return
+		}
+		// a single SOA tells the client that it is up to date, or to retry
+		// over tcp.
+		if w.LocalAddr().Network() == "udp" || !serialLess(clientSOA.Serial, soa.Serial) {
+			m.Answer = append(m.Answer, soa)
+			zm.writeMsg(w, r, m)
+			return
+		}
+		rr = zm.getIXFR(clientSOA.Serial)
+	}
+	transferType := "IXFR"
+	if rr == nil {
+		rr, err = zm.getAXFR()
+		if err != nil {
+			m.SetRcode(r, dns.RcodeServerFailure)
+			zm.writeMsg(w, r, m)
+			return
+		}
+		transferType = "AXFR"
+	}
+	transfersTotal.add(1, zm.ZoneConfig.Origin, viewName(zm.ZoneConfig.View), transferType)
+	zm.transfer(w, r, rr)
+}
+
+// lookup returns the records of type qtype at fqdn, or all of them for ANY,
+// and whether fqdn exists at all, so that an empty result is NODATA rather
+// than NXDOMAIN. Empty non-terminals and names matching a wildcard exist.
+func (zm *zoneManager) lookup(fqdn string, qtype uint16) ([]dns.RR, bool) {
+	prefix, err := zm.getPrefixByOrigin(fqdn)
+	if err != nil {
+		return nil, false
+	}
+	if cut, ok := zm.getDelegation(prefix); ok && cut == prefix {
+		// only DS queries are answered at a zone cut and there are none.
+		return nil, true
+	}
+	rr := []dns.RR{}
+	if prefix == "" {
+		if qtype == dns.TypeSOA || qtype == dns.TypeANY {
+			soa, _ := zm.getSOA(fqdn)
+			rr = append(rr, soa)
+		}
+		if qtype == dns.TypeNS || qtype == dns.TypeANY {
+			nss, _ := zm.getNS(fqdn)
+			ns := []dns.RR{}
+			for _, _ns := range nss {
+				ns = append(ns, _ns)
 			}
-			ns, err := zm.getNS(zm.ZoneConfig.Origin)
-			if err != nil {
-				w.WriteMsg(m)
-				return
+			sortRR(ns, true, nil)
+			rr = append(rr, ns...)
+		}
+		if zm.Signer != nil && (qtype == dns.TypeDNSKEY || qtype == dns.TypeANY) {
+			rr = append(rr, zm.getDNSKEY()...)
+		}
+	}
+	results, allLen := zm.resolve(fqdn, []uint16{qtype}, false)
+	return append(rr, results...), allLen != 0
+}
+
+// additional adds the in-zone addresses of NS, MX and SRV targets of answer
+// to the additional section, unless server.minimalResponses is set.
+func (zm *zoneManager) additional(m *dns.Msg, answer []dns.RR) {
+	if config.Server.MinimalResponses {
+		return
+	}
+	targets := map[string]bool{}
+	for _, rr := range answer {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.NS:
+			target = rr.Ns
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		default:
+			continue
+		}
+		if targets[target] {
+			continue
+		}
+		targets[target] = true
+		glues, _ := zm.resolve(target, []uint16{dns.TypeA, dns.TypeAAAA}, false)
+		addExtra(m, glues...)
+	}
+}
+
+// writeMsg finishes the response, signing it when the zone is signed and
+// the client asked for DNSSEC records, and truncating it to the payload size
+// of UDP clients. The rate limit is applied first, so that limited responses
+// are not signed.
+func (zm *zoneManager) writeMsg(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if !rateLimit(w, r, m) {
+		return
+	}
+	if zm.Signer != nil {
+		if opt := r.IsEdns0(); opt != nil && opt.Do() {
+			zm.signMsg(m)
+		}
+	}
+	setClientSubnet(w, r, m)
+	if w.LocalAddr().Network() == "udp" {
+		truncate(r, m)
+	}
+	w.WriteMsg(m)
+}
+
+// allowTransfer checks the client against allowTransfer and transferKeys.
+// Nobody is allowed when neither is given.
+func (zm *zoneManager) allowTransfer(w dns.ResponseWriter, r *dns.Msg) bool {
+	if len(zm.ZoneConfig.AllowTransfer) == 0 && len(zm.ZoneConfig.TransferKeys) == 0 {
+		return false
+	}
+	return matchACL(w, r, zm.ZoneConfig.AllowTransfer, zm.ZoneConfig.TransferKeys)
+}
+
+// matchACL tells whether the client address is in one of the networks and
+// the request is signed with one of the tsig keys. Either one is not checked
+// when empty.
+func matchACL(w dns.ResponseWriter, r *dns.Msg, networks []*net.IPNet, keys []string) bool {
+	if len(networks) != 0 {
+		ip, err := parseIP(w.RemoteAddr().String())
+		if err != nil {
+			return false
+		}
+		found := false
+		for _, subnet := range networks {
+			if subnet.Contains(ip) {
+				found = true
+				break
 			}
-			allRR, _ := zm.resolve(zm.ZoneConfig.Origin, []uint16{dns.TypeCNAME, dns.TypeA, dns.TypeAAAA}, true)
-			rr := []dns.RR{soa}
-			for _, _rr := range ns {
-				rr = append(rr, _rr)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(keys) != 0 {
+		tsig := r.IsTsig()
+		if tsig == nil || w.TsigStatus() != nil {
+			return false
+		}
+		found := false
+		for _, key := range keys {
+			if key == dns.CanonicalName(tsig.Hdr.Name) {
+				found = true
+				break
 			}
-			for _, _rr := range allRR {
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// getAXFR returns the whole zone framed by its SOA record.
+func (zm *zoneManager) getAXFR() ([]dns.RR, error) {
+	soa, err := zm.getSOA(zm.ZoneConfig.Origin)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := zm.getNS(zm.ZoneConfig.Origin)
+	if err != nil {
+		return nil, err
+	}
+	rr := []dns.RR{soa}
+	for _, _rr := range ns {
+		rr = append(rr, _rr)
+	}
+	rr = append(rr, zm.treeRRs(&zm.Tree)...)
+	if zm.Signer != nil {
+		rr = append(rr, zm.getDNSKEY()...)
+		for _, nsec := range zm.getNSECChain() {
+			rr = append(rr, nsec)
+		}
+		rr = zm.signRRs(rr)
+	}
+	rr = append(rr, soa)
+	return rr, nil
+}
+
+// treeRRs returns every record of tree in a stable order.
+func (zm *zoneManager) treeRRs(tree *dnsTree) []dns.RR {
+	prefixes := []string{}
+	for prefix := range tree.Records {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	rr := []dns.RR{}
+	for _, prefix := range prefixes {
+		name := zm.ZoneConfig.Origin
+		if prefix != "" {
+			name = fmt.Sprintf("%s.%s", prefix, zm.ZoneConfig.Origin)
+		}
+		for _, record := range tree.Records[prefix] {
+			if _rr := zm.toRR(name, record); _rr != nil {
 				rr = append(rr, _rr)
 			}
-			rr = append(rr, soa)
-			ch <- &dns.Envelope{RR: rr}
-			close(ch)
-			wg.Wait()
-		case dns.TypeCNAME:
-			if cnameAllLen == 0 {
-				m.SetRcode(r, dns.RcodeNameError)
-			} else {
-				m.SetRcode(r, dns.RcodeSuccess)
-			}
-			m.Ns = append(m.Ns, zm.getSOAonError())
-			w.WriteMsg(m)
-			return
 		}
 	}
-	w.WriteMsg(m)
+	return rr
+}
+
+// transfer streams rr to the client in messages of at most transferChunk
+// records.
+func (zm *zoneManager) transfer(w dns.ResponseWriter, r *dns.Msg, rr []dns.RR) {
+	ch := make(chan *dns.Envelope, len(rr)/transferChunk+1)
+	tr := new(dns.Transfer)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		if err := tr.Out(w, r, ch); err != nil {
+			log.Println(err)
+		}
+		wg.Done()
+	}()
+	for len(rr) > transferChunk {
+		ch <- &dns.Envelope{RR: rr[:transferChunk]}
+		rr = rr[transferChunk:]
+	}
+	ch <- &dns.Envelope{RR: rr}
+	close(ch)
+	wg.Wait()
 }
 
 func (zm *zoneManager) resolve(fqdn string, dnsTypes []uint16, any bool) ([]dns.RR, int) {
@@ -227,10 +460,16 @@ func (zm *zoneManager) resolve(fqdn string, dnsTypes []uint16, any bool) ([]dns.
 		if err != nil {
 			return nil, 0
 		}
-		records[fqdn] = zm.Tree.Records[prefix]
-		if records == nil {
+		if _, ok := zm.getDelegation(prefix); ok {
+			// occluded by a zone cut, see referral.
 			return nil, 0
 		}
+		if wildcard, ok := zm.getWildcard(prefix); ok {
+			prefix = wildcard
+		}
+		if zm.Tree.hasName(prefix) {
+			records[fqdn] = zm.Tree.Records[prefix]
+		}
 	}
 	keys := make([]string, len(records))
 	i := 0
@@ -242,40 +481,74 @@ func (zm *zoneManager) resolve(fqdn string, dnsTypes []uint16, any bool) ([]dns.
 	for _, name := range keys {
 		for _, record := range records[name] {
 			for _, t := range dnsTypes {
-				if t == dns.TypeA && record.DNSType == dns.TypeA {
-					rr = append(rr, &dns.A{
-						Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
-						A:   record.A,
-					})
-				}
-				if t == dns.TypeAAAA && record.DNSType == dns.TypeAAAA {
-					rr = append(rr, &dns.AAAA{
-						Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
-						AAAA: record.AAAA,
-					})
-				}
-				if t == dns.TypeTXT && record.DNSType == dns.TypeTXT {
-					rr = append(rr, &dns.TXT{
-						Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
-						Txt: []string{record.TXT},
-					})
-				}
-				if t == dns.TypeCNAME && record.DNSType == dns.TypeCNAME {
-					rr = append(rr, &dns.CNAME{
-						Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
-						Target: record.CNAME,
-					})
+				if t == record.DNSType || t == dns.TypeANY {
+					if _rr := zm.toRR(name, record); _rr != nil {
+						rr = append(rr, _rr)
+					}
 				}
 			}
 		}
 	}
-	sortRR(rr, !any)
+	sortRR(rr, !any, nil)
 	return rr, len(records)
 }
 
+// toRR converts a record of the tree to a resource record named name.
+func (zm *zoneManager) toRR(name string, record dnsRecord) dns.RR {
+	switch record.DNSType {
+	case dns.TypeA:
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
+			A:   record.A,
+		}
+	case dns.TypeAAAA:
+		return &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
+			AAAA: record.AAAA,
+		}
+	case dns.TypeTXT:
+		return &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
+			Txt: []string{record.TXT},
+		}
+	case dns.TypePTR:
+		return &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
+			Ptr: record.PTR,
+		}
+	case dns.TypeNS:
+		return &dns.NS{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
+			Ns:  record.NS,
+		}
+	case dns.TypeMX:
+		return &dns.MX{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
+			Preference: record.MX.Preference,
+			Mx:         record.MX.Exchange,
+		}
+	case dns.TypeSRV:
+		return &dns.SRV{
+			Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
+			Priority: record.SRV.Priority,
+			Weight:   record.SRV.Weight,
+			Port:     record.SRV.Port,
+			Target:   record.SRV.Target,
+		}
+	case dns.TypeCNAME:
+		return &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
+			Target: record.CNAME,
+		}
+	}
+	return nil
+}
+
+// getSOAonError returns the SOA record of negative answers, whose TTL is the
+// negative caching TTL of RFC 2308.
 func (zm *zoneManager) getSOAonError() *dns.SOA {
 	return &dns.SOA{
-		Hdr:     dns.RR_Header{Name: zm.ZoneConfig.Origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: zm.ZoneConfig.TTL},
+		Hdr:     dns.RR_Header{Name: zm.ZoneConfig.Origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: zm.getNegativeTTL()},
 		Ns:      zm.ZoneConfig.SOA.NS,
 		Mbox:    zm.ZoneConfig.SOA.MBox,
 		Serial:  zm.getSerial(),
@@ -286,8 +559,16 @@ func (zm *zoneManager) getSOAonError() *dns.SOA {
 	}
 }
 
+// getNegativeTTL returns the smaller of the SOA TTL and its minimum field.
+func (zm *zoneManager) getNegativeTTL() uint32 {
+	if zm.ZoneConfig.SOA.MinTTL < zm.ZoneConfig.TTL {
+		return zm.ZoneConfig.SOA.MinTTL
+	}
+	return zm.ZoneConfig.TTL
+}
+
 func (zm *zoneManager) getSOA(qName string) (*dns.SOA, error) {
-	if qName != zm.ZoneConfig.Origin {
+	if !strings.EqualFold(qName, zm.ZoneConfig.Origin) {
 		return nil, fmt.Errorf("Not found")
 	}
 	return &dns.SOA{
@@ -303,7 +584,7 @@ func (zm *zoneManager) getSOA(qName string) (*dns.SOA, error) {
 }
 
 func (zm *zoneManager) getNS(qName string) ([]*dns.NS, error) {
-	if qName != zm.ZoneConfig.Origin {
+	if !strings.EqualFold(qName, zm.ZoneConfig.Origin) {
 		return nil, fmt.Errorf("Not found")
 	}
 	result := []*dns.NS{}
@@ -349,14 +630,21 @@ func (zm *zoneManager) updateSerial() {
 	}
 }
 
-func (zm *zoneManager) includesBySuffix(fqdn string) bool {
-	if strings.HasSuffix(fqdn, zm.ZoneConfig.Suffix) || fqdn == zm.ZoneConfig.Suffix {
-		return true
+// name identifies the zone manager, which is the suffix of the zone prefixed
+// with the view when views are configured.
+func (zm *zoneManager) name() string {
+	if zm.ZoneConfig.View == nil {
+		return zm.ZoneConfig.Suffix
 	}
-	return false
+	return fmt.Sprintf("%s/%s", zm.ZoneConfig.View.Name, zm.ZoneConfig.Suffix)
+}
+
+func (zm *zoneManager) includesBySuffix(fqdn string) bool {
+	return dns.IsSubDomain(zm.ZoneConfig.Suffix, dns.CanonicalName(fqdn))
 }
 
 func (zm *zoneManager) getPrefixBySuffix(fqdn string) (string, error) {
+	fqdn = dns.CanonicalName(fqdn)
 	if fqdn == zm.ZoneConfig.Suffix {
 		return "", nil
 	}
@@ -366,12 +654,99 @@ func (zm *zoneManager) getPrefixBySuffix(fqdn string) (string, error) {
 	return fqdn[:len(fqdn)-len(zm.ZoneConfig.Suffix)-1], nil
 }
 
+// getDelegation returns the prefix of the topmost zone cut at or above
+// prefix, which is a name other than the apex with NS records.
+func (zm *zoneManager) getDelegation(prefix string) (string, bool) {
+	cut, ok := "", false
+	for off, end := 0, prefix == ""; !end; off, end = dns.NextLabel(prefix, off) {
+		for _, record := range zm.Tree.Records[prefix[off:]] {
+			if record.DNSType == dns.TypeNS {
+				cut, ok = prefix[off:], true
+				break
+			}
+		}
+	}
+	return cut, ok
+}
+
+// referral makes m a referral to the child zone when q is at or below a zone
+// cut, with the NS records of the cut in the authority section and the
+// addresses of in-zone name servers as glue. The DS records of a cut belong
+// to the parent and are answered as usual.
+func (zm *zoneManager) referral(m *dns.Msg, q dns.Question) bool {
+	prefix, err := zm.getPrefixByOrigin(q.Name)
+	if err != nil {
+		return false
+	}
+	cut, ok := zm.getDelegation(prefix)
+	if !ok || cut == prefix && q.Qtype == dns.TypeDS {
+		return false
+	}
+	name := fmt.Sprintf("%s.%s", cut, zm.ZoneConfig.Origin)
+	m.Authoritative = false
+	targets := map[string]bool{}
+	for _, record := range zm.Tree.Records[cut] {
+		if record.DNSType != dns.TypeNS {
+			continue
+		}
+		m.Ns = append(m.Ns, zm.toRR(name, record))
+		if targets[record.NS] {
+			continue
+		}
+		targets[record.NS] = true
+		addExtra(m, zm.getGlue(record.NS)...)
+	}
+	return true
+}
+
+// getGlue returns the addresses of an in-zone name server. Unlike resolve,
+// records occluded by a zone cut are returned.
+func (zm *zoneManager) getGlue(target string) []dns.RR {
+	prefix, err := zm.getPrefixByOrigin(target)
+	if err != nil {
+		return nil
+	}
+	rr := []dns.RR{}
+	for _, record := range zm.Tree.Records[prefix] {
+		if record.DNSType == dns.TypeA || record.DNSType == dns.TypeAAAA {
+			rr = append(rr, zm.toRR(target, record))
+		}
+	}
+	return rr
+}
+
+// getWildcard returns the prefix of the wildcard record synthesizing prefix
+// (RFC 4592), which is "*." followed by the closest encloser of prefix.
+func (zm *zoneManager) getWildcard(prefix string) (string, bool) {
+	if prefix == "" || zm.Tree.hasName(prefix) {
+		return "", false
+	}
+	for off, end := dns.NextLabel(prefix, 0); ; off, end = dns.NextLabel(prefix, off) {
+		encloser := ""
+		if !end {
+			encloser = prefix[off:]
+		}
+		if !zm.Tree.hasName(encloser) {
+			continue
+		}
+		wildcard := "*"
+		if encloser != "" {
+			wildcard = "*." + encloser
+		}
+		_, ok := zm.Tree.Records[wildcard]
+		return wildcard, ok
+	}
+}
+
+// getPrefixByOrigin returns the lowercased name of fqdn relative to the
+// origin, which is how names are kept in the tree.
 func (zm *zoneManager) getPrefixByOrigin(fqdn string) (string, error) {
+	fqdn = dns.CanonicalName(fqdn)
+	if !dns.IsSubDomain(zm.ZoneConfig.Origin, fqdn) {
+		return "", fmt.Errorf("invalid origin")
+	}
 	if fqdn == zm.ZoneConfig.Origin {
 		return "", nil
 	}
-	if !strings.HasSuffix(fqdn, "."+zm.ZoneConfig.Origin) {
-		return "", fmt.Errorf("invalid origin")
-	}
 	return fqdn[:len(fqdn)-len(zm.ZoneConfig.Origin)-1], nil
 }